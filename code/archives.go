@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// tags added to every archive uploaded to the destination container, alongside the user supplied tar file tags.
+// These let archives be found and filtered without relying on the blob path
+const (
+	archiveSourceContainerTag = "SourceContainer"
+	archiveDateTag            = "ArchiveDate"
+)
+
+// archiveBlob describes an archive found in the destination container
+type archiveBlob struct {
+	Name            string
+	SourceContainer string
+	Date            time.Time
+	Compressed      bool
+	Size            int64
+	LastModified    time.Time
+	Tags            map[string]string
+	HasManifest     bool
+}
+
+// parseArchiveDate accepts either a date in the same format as the default timestamp or an RFC3339 time
+func parseArchiveDate(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to parse date [%s] - expected YYYY-MM-DD or RFC3339", s)
+	}
+	return t, nil
+}
+
+// newArchiveBlob works out the source container and date of an archive blob. Tags are used when they exist, otherwise
+// the derived tar file name <container>-<YYYY-MM-DD>.<ext> is parsed. ok is false if the blob is not recognised as an archive
+func newArchiveBlob(blobItem *container.BlobItem) (archiveBlob, bool) {
+	a := archiveBlob{
+		Name: *blobItem.Name,
+		Tags: map[string]string{},
+	}
+	base := path.Base(a.Name)
+	switch {
+	case strings.HasSuffix(base, ".tgz"):
+		a.Compressed = true
+		base = strings.TrimSuffix(base, ".tgz")
+	case strings.HasSuffix(base, ".tar"):
+		base = strings.TrimSuffix(base, ".tar")
+	default:
+		return a, false
+	}
+	if blobItem.Properties != nil {
+		if blobItem.Properties.ContentLength != nil {
+			a.Size = *blobItem.Properties.ContentLength
+		}
+		if blobItem.Properties.LastModified != nil {
+			a.LastModified = *blobItem.Properties.LastModified
+		}
+	}
+	if blobItem.BlobTags != nil {
+		for _, tag := range blobItem.BlobTags.BlobTagSet {
+			a.Tags[*tag.Key] = *tag.Value
+		}
+	}
+
+	a.SourceContainer = a.Tags[archiveSourceContainerTag]
+	if d, err := parseArchiveDate(a.Tags[archiveDateTag]); err == nil {
+		a.Date = d
+	}
+	// fall back on the derived file name
+	if len(base) > 11 && base[len(base)-11] == '-' {
+		if d, err := time.Parse("2006-01-02", base[len(base)-10:]); err == nil {
+			if a.SourceContainer == "" {
+				a.SourceContainer = base[:len(base)-11]
+			}
+			if a.Date.IsZero() {
+				a.Date = d
+			}
+		}
+	}
+	// last resort is the date prefix used by CopyArchiveToStorageContainer
+	if a.Date.IsZero() {
+		if d, err := parseArchiveDate(strings.SplitN(a.Name, "/", 2)[0]); err == nil {
+			a.Date = d
+		}
+	}
+	if a.SourceContainer == "" || a.Date.IsZero() {
+		return a, false
+	}
+	return a, true
+}
+
+// listArchives lists the archives in the destination container, optionally only those taken from sourceContainer.
+// Archives are returned oldest first
+func (b *BlobArchiver) listArchives(ctx context.Context, sourceContainer string) ([]archiveBlob, error) {
+	if b.DestinationConnectionString == "" || b.DestinationContainerName == "" {
+		return nil, fmt.Errorf("destination connection string or container name not provided")
+	}
+	containerClient, err := b.createContainerClient(b.DestinationConnectionString, b.DestinationContainerName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container client: %w", err)
+	}
+
+	var archives []archiveBlob
+	manifests := map[string]bool{}
+	pager := containerClient.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+		Include: container.ListBlobsInclude{Tags: true},
+	})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list blobs: %w", err)
+		}
+		for _, blobItem := range page.Segment.BlobItems {
+			if strings.HasSuffix(*blobItem.Name, manifestSuffix) {
+				manifests[strings.TrimSuffix(*blobItem.Name, manifestSuffix)] = true
+				continue
+			}
+			a, ok := newArchiveBlob(blobItem)
+			if !ok {
+				continue
+			}
+			if sourceContainer != "" && a.SourceContainer != sourceContainer {
+				continue
+			}
+			archives = append(archives, a)
+		}
+	}
+	for i := range archives {
+		archives[i].HasManifest = manifests[archives[i].Name]
+	}
+	sort.SliceStable(archives, func(i, j int) bool {
+		if archives[i].Date.Equal(archives[j].Date) {
+			return archives[i].LastModified.Before(archives[j].LastModified)
+		}
+		return archives[i].Date.Before(archives[j].Date)
+	})
+	return archives, nil
+}
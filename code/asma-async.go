@@ -2,30 +2,19 @@ package main
 
 import (
 	"context"
-	"flag"
 	"fmt"
 	"log"
 	"os"
 	"strings"
-	"time"
 
 	"go.uber.org/automaxprocs/maxprocs"
 )
 
-// Allowed operations
-var (
-	configFile        string = os.Getenv("BACKUP_CONFIG_FILE")
-	allowedOperations        = []string{"backup", "restore", "backup-to-container", "download-tarfile", "upload-tarfile", "delete-all-blobs", "delete-tarfile", "count"}
-)
+var configFile string = os.Getenv("BACKUP_CONFIG_FILE")
 
 // Check if the given operation is valid
 func isValidOperation(op string) bool {
-	for _, allowedOp := range allowedOperations {
-		if op == allowedOp {
-			return true
-		}
-	}
-	return false
+	return findCommand(op) != nil
 }
 
 // Extracts the first argument that is a valid operation and returns the remaining arguments
@@ -39,43 +28,36 @@ func extractOperation(args []string) (string, []string) {
 	return "", args
 }
 
-// Struct to store flag metadata
-type FlagInfo struct {
-	ShortName string
-	LongName  string
-	Desc      string
-}
-
-// List of flags with metadata
-var flagsInfo = []FlagInfo{
-	{"-c", "--connection-string", "Connection string"},
-	{"-n", "--container-name", "Container name"},
-	{"-p", "--prefix", "Prefix"},
-	{"-z", "--compression", "Enable compression"},
-	{"-P", "--path", "Path"},
-	{"-t", "--tar-file-name", "Tar file name"},
-	{"-tags", "--tar-file-tags", "Tags to identify and filter tar file: defaults to \"Name\"=\"BlobArchive\""},
-	{"-o", "--overwrite", "Overwrite existing files"},
-	{"-dc", "--destination-connection-string", "Destination connection string"},
-	{"-dn", "--destination-container-name", "Destination container name"},
-	{"-dp", "--destination-path", "Destination path"},
-	{"-T", "--time", "Timestamp string - defaults to time.Now().Format(\"2006-01-02\")"},
-	{"-b", "--batch-size", "Batch size of file each worker is allocated on backup - defaults to 25"},
-	{"-w", "--workers", "Number of concurrent processes"},
+// Extracts a --yes-i-mean-<container> argument and returns the container name and the remaining arguments
+func extractDeleteConfirmation(args []string) (string, []string) {
+	for i, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if strings.HasPrefix(arg, "-") && strings.HasPrefix(name, confirmDeletePrefix) {
+			return strings.TrimPrefix(name, confirmDeletePrefix), append(args[:i], args[i+1:]...)
+		}
+	}
+	return "", args
 }
 
-// Prints enhanced help message
-func printHelp() {
-	fmt.Println("Usage: main.go <operation> [options]")
-	fmt.Println("\nOperations:")
-	for _, op := range allowedOperations {
-		fmt.Printf("  %s\n", op)
-	}
-	fmt.Println("\nOptions:")
-	for _, flag := range flagsInfo {
-		fmt.Printf("  %-5s %-32s %s\n", flag.ShortName, flag.LongName, flag.Desc)
+// Finds a --profile argument without removing it, as the profile sets the flag defaults before the flags are parsed.
+// It defaults to $BACKUP_PROFILE
+func findProfile(args []string) string {
+	profile := os.Getenv("BACKUP_PROFILE")
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "profile" {
+			continue
+		}
+		if hasValue {
+			profile = value
+		} else if i+1 < len(args) {
+			profile = args[i+1]
+		}
 	}
-	os.Exit(0)
+	return profile
 }
 
 // Implement the flag.Value interface for stringMapFlag
@@ -99,11 +81,25 @@ func (sm *StringMapFlag) Set(value string) error {
 	return nil
 }
 
+// Implement the flag.Value interface for StringListFlag
+func (sl *StringListFlag) String() string {
+	return strings.Join(*sl, ",")
+}
+
+func (sl *StringListFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v != "" {
+			*sl = append(*sl, v)
+		}
+	}
+	return nil
+}
+
 func main() {
 
-	fileConfig, err := NewConfigFromConfigFile(configFile)
-	if err != nil {
-		log.Printf("error parsing configuration file - falling back on parameters : %v", err)
+	fileConfig, configErr := NewConfigFromConfigFile(configFile)
+	if configErr != nil && configFile != "" {
+		log.Printf("error parsing configuration file - falling back on parameters : %v", configErr)
 	}
 
 	// set the maximum parallel go routines to the number of available cores to the container
@@ -113,104 +109,83 @@ func main() {
 		log.Fatalf("failed to set GOMAXPROCS: %v", err)
 	}
 
-	tarFileTags := StringMapFlag{}
-
-	// Check if -h or --help is in args before parsing flags
-	for _, arg := range os.Args {
-		if arg == "-h" || arg == "--help" {
-			printHelp()
-		}
-	}
-
 	// Extract the operation
 	operation, remainingArgs := extractOperation(os.Args[1:])
 	if operation == "" {
-		fmt.Println("Error: You must specify an operation: backup, restore, delete-all-blobs, or delete-tarfile")
-		printHelp()
+		for _, arg := range remainingArgs {
+			if arg == "-h" || arg == "--help" {
+				printHelp(os.Stdout)
+				os.Exit(0)
+			}
+		}
+		fmt.Fprintln(os.Stderr, "Error: You must specify an operation")
+		printHelp(os.Stderr)
+		os.Exit(2)
 	}
+	cmd := findCommand(operation)
 
-	// Define flags
-	connStr := flag.String("c", "", "Connection string (short: -c)")
-	flag.StringVar(connStr, "connection-string", fileConfig.GetSourceAccountConnectString(), "Connection string")
-
-	containerName := flag.String("n", "", "Container name (short: -n)")
-	flag.StringVar(containerName, "container-name", fileConfig.GetSourceContainerName(), "Container name")
-
-	prefix := flag.String("p", "", "Prefix (short: -p)")
-	flag.StringVar(prefix, "prefix", "", "Prefix")
-
-	compression := flag.Bool("z", false, "Enable compression (short: -z)")
-	flag.BoolVar(compression, "compression", false, "Enable compression")
-
-	path := flag.String("P", "", "Path (short: -P)")
-	flag.StringVar(path, "path", "", "Path")
-
-	tarFileName := flag.String("t", "", "Tar file name (short: -t)")
-	flag.StringVar(tarFileName, "tar-file-name", "", "Tar file name")
-
-	flag.Var(&tarFileTags, "tags", "Comma-separated key=value pairs (e.g., key1=value1,key2=value2)")
-
-	overwrite := flag.Bool("o", false, "Overwrite existing files (short: -o)")
-	flag.BoolVar(overwrite, "overwrite", false, "Overwrite existing files")
-
-	destConnStr := flag.String("dc", "", "Destination connection string (short: -dc)")
-	flag.StringVar(destConnStr, "destination-connection-string", fileConfig.GetDestAccountConnectString(), "Destination connection string")
-
-	destContainerName := flag.String("dn", "", "Destination container name (short: -dn)")
-	flag.StringVar(destContainerName, "destination-container-name", fileConfig.GetDestinationContainerName(), "Destination container name")
-
-	destPath := flag.String("dp", "", "Destination path (short: -dp)")
-	flag.StringVar(destPath, "destination-path", "", "Destination path")
-
-	timeStr := flag.String("T", time.Now().Format("2006-01-02"), "Timestamp string (short: -T)")
-	flag.StringVar(timeStr, "time", time.Now().Format("2006-01-02"), "Timestamp string")
-
-	batchSize := flag.Int("b", 25, "Batch size (short: -b)")
-	flag.IntVar(batchSize, "batch-size", 25, "Batch size - defaults to 25")
-
-	workers := flag.Int("w", 8, "Workers (short: -w)")
-	flag.IntVar(workers, "workers", 25, "Number of concurrent processes - defaults to 8")
-
-	// flag.CommandLine.Parse(remainingArgs)
+	// diff exits with 1 when there are differences, so like diff(1) it exits with 2 when it fails
+	exitCode := 1
+	if operation == "diff" {
+		exitCode = 2
+	}
+	fatalf := func(format string, v ...any) {
+		log.Printf(format, v...)
+		os.Exit(exitCode)
+	}
 
-	// Override flag.CommandLine so we parse only remainingArgs
-	// flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
-	flag.CommandLine.Parse(remainingArgs)
+	switch operation {
+	case "help":
+		if len(remainingArgs) > 0 && findCommand(remainingArgs[0]) != nil {
+			findCommand(remainingArgs[0]).printHelp(os.Stdout)
+		} else {
+			printHelp(os.Stdout)
+		}
+		return
+	case "completion":
+		if len(remainingArgs) != 1 {
+			log.Fatal("completion needs a shell: bash or zsh")
+		}
+		if err := completionScript(os.Stdout, remainingArgs[0]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	// Add a default flag if there are none set
-	if len(tarFileTags) == 0 {
-		tarFileTags["Name"] = "BlobArchive"
+	// the delete confirmation flag includes the container name so it cannot be defined as a normal flag
+	var confirmedContainer string
+	if operation == "delete-all-blobs" {
+		confirmedContainer, remainingArgs = extractDeleteConfirmation(remainingArgs)
 	}
-	// Populate struct
-	archiver := NewBlobArchiver(
-		*connStr,
-		*containerName,
-		*prefix,
-		*compression,
-		*path,
-		*tarFileName,
-		tarFileTags,
-		*overwrite,
-		*destConnStr,
-		*destContainerName,
-		*destPath,
-		*timeStr,
-		*batchSize,
-		*workers,
-	)
 
-	// Validate required flags
-	if archiver.ConnectionString == "" {
-		fmt.Println("Error: Connection string (-c or --connection-string) is required")
-		flag.Usage() // Show help message
-		os.Exit(1)   // Exit with an error code
+	// each operation only accepts its own flags. They default to the configuration file, the selected profile and
+	// the environment
+	profile := findProfile(remainingArgs)
+	if profile != "" && configFile == "" {
+		fatalf("unable to use profile [%s] - BACKUP_CONFIG_FILE is not set", profile)
+	}
+	if profile != "" && configErr != nil {
+		fatalf("unable to use profile [%s] - %v", profile, configErr)
+	}
+	effective, err := fileConfig.resolve(profile)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	opts := newOptions(effective)
+	flags := cmd.flagSet(opts)
+	flags.Parse(remainingArgs)
+	if err := cmd.validate(flags); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		flags.Usage()
+		os.Exit(2)
 	}
 
-	if archiver.ContainerName == "" {
-		fmt.Println("Error: Container Namme (-n or --container-name) is required")
-		flag.Usage() // Show help message
-		os.Exit(1)   // Exit with an error code
+	// Add a default flag if there are none set
+	if len(opts.TarFileTags) == 0 {
+		opts.TarFileTags["Name"] = "BlobArchive"
 	}
+	archiver := &opts.BlobArchiver
+	archiver.ConfirmedContainer = confirmedContainer
 
 	switch operation {
 
@@ -218,10 +193,20 @@ func main() {
 		if err := archiver.StreamBlobsToTar(); err != nil {
 			log.Fatal("error backing up storage container to tar file:", err)
 		}
+		if err := archiver.catalogBackup(false); err != nil {
+			log.Print("backup complete but not added to the catalog - error :", err)
+		}
 	case "backup-to-container":
-		log.Print("checking for old tar backups")
-		if err := deleteOldArchives(archiver.Path, []string{"tar", "tgz", "tar.tz"}); err != nil {
-			log.Print("error trying to delete old tar files - continuing, but backup may fail due to lack of space - error :", err)
+		if opts.KeepLocal < 1 {
+			log.Fatalf("--keep-local must be at least 1, not [%d] - the newest local archive is always kept", opts.KeepLocal)
+		}
+		log.Print("checking free space for the tar backup")
+		removed, err := makeSpaceForBackup(archiver.Path, archivePatterns)
+		if err != nil {
+			log.Print("error trying to make space for the tar backup - continuing, but backup may fail due to lack of space - error :", err)
+		}
+		if err := archiver.uncatalogLocalArchives(removed); err != nil {
+			log.Print("unable to remove the deleted tar files from the catalog - error :", err)
 		}
 		log.Print("beginning tar backup")
 		if err := archiver.StreamBlobsToTar(); err != nil {
@@ -233,11 +218,38 @@ func main() {
 			log.Fatal("error copying tarfile to storage container:", err)
 		}
 		log.Print("archive to container complete")
+		if err := archiver.catalogBackup(true); err != nil {
+			log.Print("archive uploaded but not added to the catalog - error :", err)
+		}
+		// old archives are only deleted once the new one is safely in the container
+		log.Printf("keeping the last [%d] local tar backups", opts.KeepLocal)
+		removed, err = pruneLocalArchives(archiver.Path, archivePatterns, opts.KeepLocal)
+		if err != nil {
+			log.Print("error trying to delete old tar files - error :", err)
+		}
+		if err := archiver.uncatalogLocalArchives(removed); err != nil {
+			log.Print("unable to remove the deleted tar files from the catalog - error :", err)
+		}
 	case "upload-tarfile":
 		if err := archiver.CopyArchiveToStorageContainer(); err != nil {
 			log.Fatal("error copying tarfile to storage container:", err)
 		}
+		if err := archiver.catalogBackup(true); err != nil {
+			log.Print("archive uploaded but not added to the catalog - error :", err)
+		}
 	case "restore":
+		if opts.AsOf != "" {
+			if err := archiver.RestoreAsOf(opts.AsOf); err != nil {
+				log.Fatal(err)
+			}
+			break
+		}
+		if archiver.Staged {
+			if err := archiver.StagedRestore(); err != nil {
+				log.Fatal(err)
+			}
+			break
+		}
 		if err := archiver.RestoreFromTarFile(); err != nil {
 			log.Fatal(err)
 		}
@@ -267,13 +279,87 @@ func main() {
 		); err != nil {
 			log.Fatal(err)
 		}
+		if err := archiver.downloadSidecars(context.Background(),
+			archiver.DestinationConnectionString,
+			archiver.DestinationContainerName,
+			archiver.TarFileName,
+			archiver.destinationPath,
+		); err != nil {
+			log.Fatal(err)
+		}
+	case "extract":
+		if err := archiver.ExtractTarFile(); err != nil {
+			log.Fatal(err)
+		}
+	case "undelete":
+		if err := archiver.UndeleteBlobs(); err != nil {
+			log.Fatalf("error undeleting blobs in azure container %s - %v", archiver.ContainerName, err)
+		}
+	case "prune":
+		if err := archiver.PruneArchives(); err != nil {
+			log.Fatalf("error pruning archives in azure container %s - %v", archiver.DestinationContainerName, err)
+		}
+	case "diff":
+		changes, err := archiver.Diff()
+		if err != nil {
+			fatalf("unable to diff : %v", err)
+		}
+		if err := writeDiff(os.Stdout, changes, opts.Output); err != nil {
+			fatalf("unable to write diff : %v", err)
+		}
+		// like diff(1), differences exit with 1 so scripts can check for them
+		if len(changes) > 0 {
+			os.Exit(1)
+		}
+	case "list-archives":
+		archives, err := archiver.ListArchives()
+		if err != nil {
+			log.Fatalf("error listing archives in azure container %s - %v", archiver.DestinationContainerName, err)
+		}
+		if err := writeArchives(os.Stdout, archives, opts.Output); err != nil {
+			log.Fatal("unable to write archive list :", err)
+		}
+	case "inspect":
+		if archiver.Entry != "" {
+			if err := archiver.InspectEntry(os.Stdout); err != nil {
+				log.Fatal(err)
+			}
+			break
+		}
+		entries, err := archiver.InspectArchive()
+		if err != nil {
+			log.Fatalf("error inspecting %s - %v", archiver.archiveName(), err)
+		}
+		if err := writeArchiveEntries(os.Stdout, entries, opts.Output); err != nil {
+			log.Fatal("unable to write archive entries :", err)
+		}
+	case "search":
+		results, err := archiver.SearchCatalog()
+		if err != nil {
+			log.Fatal("unable to search the catalog :", err)
+		}
+		if err := writeSearchResults(os.Stdout, results, opts.Output); err != nil {
+			log.Fatal("unable to write search results :", err)
+		}
+	case "config":
+		effective.Write(os.Stdout)
+	case "serve-archive":
+		if err := archiver.ServeArchive(opts.Listen, opts.BasicAuth); err != nil {
+			log.Fatal(err)
+		}
+	case "verify":
+		if err := archiver.VerifyArchive(); err != nil {
+			log.Fatal(err)
+		}
 	case "count":
 		log.Printf("counting blobs in container %v", archiver.ContainerName)
-		n, err := archiver.CountBlobs()
+		inv, err := archiver.InventoryBlobs()
 		if err != nil {
 			log.Fatal("unable to count blobs :", err)
 		}
-		log.Printf("number of blobs found : [%v]", n)
+		if err := inv.Write(os.Stdout, opts.Output); err != nil {
+			log.Fatal("unable to write inventory :", err)
+		}
 	default:
 		log.Fatal("unkown error occured in initialising command args")
 
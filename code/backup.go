@@ -2,15 +2,18 @@ package main
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 	"github.com/schollz/progressbar/v3"
@@ -19,49 +22,44 @@ import (
 
 // StreamBlobsToTar downloads blobs, archives them into a tar file, and uses goroutines for concurrency.
 func (b *BlobArchiver) StreamBlobsToTar() error {
+	_, err := b.streamBlobsToTar(nil)
+	return err
+}
+
+// streamBlobsToTar archives the given blobs, or every blob in the container when blobs is nil. It returns the number of
+// batches that failed to archive
+func (b *BlobArchiver) streamBlobsToTar(blobs []*container.BlobItem) (int, error) {
 	var bar = progressbar.Default(-1, "downloading blobs")
 
 	// Create a container client for source storage account
 	containerClient, err := b.createContainerClient(b.ConnectionString, b.ContainerName)
 	if err != nil {
-		return fmt.Errorf("failed to create container client: %w", err)
+		return 0, fmt.Errorf("failed to create container client: %w", err)
 	}
 
 	// Create directory if it doesn't exist
 	if b.Path != "" {
 		if err := os.MkdirAll(b.Path, os.ModePerm); err != nil {
-			return fmt.Errorf("failed to create directory: %w", err)
+			return 0, fmt.Errorf("failed to create directory: %w", err)
 		}
 	}
 
 	// Open tar file for writing
 	tarFile, err := os.Create(b.TarFile())
 	if err != nil {
-		return fmt.Errorf("failed to create tar file: %w", err)
+		return 0, fmt.Errorf("failed to create tar file: %w", err)
 	}
 	defer tarFile.Close()
 
-	var tarWriter *tar.Writer
-	var gzipWriter *gzip.Writer
-
-	if b.Compression {
-		// maximise compression. I might make this switchable later on but, at the moment, that just feels like Yak shaving
-		gzipWriter, err = gzip.NewWriterLevel(tarFile, 9)
-		if err != nil {
-			return fmt.Errorf("failed to create gzip writer : %v", err)
-		}
-		defer gzipWriter.Close()
-		tarWriter = tar.NewWriter(gzipWriter)
-	} else {
-		tarWriter = tar.NewWriter(tarFile)
+	// the archive writer protects the tar file, and the manifest entries and index written with it
+	archive, err := newArchiveWriter(tarFile, b.Compression)
+	if err != nil {
+		return 0, err
 	}
-	defer tarWriter.Close()
-
-	// Mutex to protect tar file access
-	var tarMutex sync.Mutex
 
 	// Wait group to synchronize goroutines
 	var wg sync.WaitGroup
+	var failedBatches atomic.Int64
 
 	// Channel to send batches of blobs
 	blobChan := make(chan []*container.BlobItem, b.BatchSize)
@@ -73,31 +71,37 @@ func (b *BlobArchiver) StreamBlobsToTar() error {
 		go func() {
 			defer wg.Done()
 			for batch := range blobChan {
-				if err := b.processBlobBatch(batch, containerClient, tarWriter, &tarMutex); err != nil {
+				if err := b.processBlobBatch(batch, containerClient, archive); err != nil {
 					fmt.Printf("Error processing blob batch: %v\n", err)
+					failedBatches.Add(1)
 				}
 			}
 		}()
 	}
 
-	// Read blobs from Azure and send them in batches to the channel
-	pager := containerClient.NewListBlobsFlatPager(nil)
 	batch := make([]*container.BlobItem, 0, b.BatchSize)
-
-	for pager.More() {
-		page, err := pager.NextPage(context.Background())
-		if err != nil {
-			return fmt.Errorf("failed to list blobs: %w", err)
+	addToBatch := func(blobItem *container.BlobItem) {
+		batch = append(batch, blobItem)
+		batchLen := len(batch)
+		if batchLen >= b.BatchSize {
+			blobChan <- batch
+			batch = make([]*container.BlobItem, 0, b.BatchSize) // Reset batch
+			bar.Add(batchLen)
 		}
+	}
 
-		for _, blobItem := range page.Segment.BlobItems {
-			batch = append(batch, blobItem)
-			batchLen := len(batch)
-			if batchLen >= b.BatchSize {
-				blobChan <- batch
-				batch = make([]*container.BlobItem, 0, b.BatchSize) // Reset batch
-				bar.Add(batchLen)
-			}
+	if blobs != nil {
+		for _, blobItem := range blobs {
+			addToBatch(blobItem)
+		}
+	} else {
+		// Read blobs from Azure and send them in batches to the channel
+		err := b.forEachBlob(context.Background(), containerClient, "", container.ListBlobsInclude{}, func(blobItem *container.BlobItem) error {
+			addToBatch(blobItem)
+			return nil
+		})
+		if err != nil {
+			return 0, err
 		}
 	}
 	// Process remaining blobs in the last batch
@@ -109,12 +113,22 @@ func (b *BlobArchiver) StreamBlobsToTar() error {
 	close(blobChan) // Close the channel to signal workers to stop
 	wg.Wait()       // Wait for all workers to finish
 
+	if err := archive.Close(); err != nil {
+		return 0, err
+	}
+	if err := archive.writeIndex(indexFile(b.TarFile())); err != nil {
+		return 0, fmt.Errorf("failed to write index: %w", err)
+	}
+	if err := b.writeBackupManifest(context.Background(), containerClient, archive.entries); err != nil {
+		return 0, fmt.Errorf("failed to write manifest: %w", err)
+	}
+
 	fmt.Printf("Blobs archived to %s\n", b.TarFile())
-	return nil
+	return int(failedBatches.Load()), nil
 }
 
 // processBlobBatch downloads blobs in a batch and adds them to the tar archive.
-func (b *BlobArchiver) processBlobBatch(batch []*container.BlobItem, containerClient *container.Client, tarWriter *tar.Writer, tarMutex *sync.Mutex) error {
+func (b *BlobArchiver) processBlobBatch(batch []*container.BlobItem, containerClient *container.Client, archive *archiveWriter) error {
 	for _, blobItem := range batch {
 		// fmt.Printf("adding blob: %s\n", *blobItem.Name)
 
@@ -123,32 +137,35 @@ func (b *BlobArchiver) processBlobBatch(batch []*container.BlobItem, containerCl
 
 		// Download the blob
 		get, err := blobClient.DownloadStream(context.Background(), nil)
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			// deleted since it was listed, or since the inventory report it was read from
+			log.Printf("blob %s no longer exists, skipping", *blobItem.Name)
+			continue
+		}
 		if err != nil {
 			return fmt.Errorf("failed to download blob %s: %w", *blobItem.Name, err)
 		}
 		defer get.Body.Close()
 
-		// Write blob to tar file
+		// Write blob to tar file. The size and time come from the download rather than the listing, as the blob may
+		// have changed since it was listed
 		header := &tar.Header{
 			Name:    *blobItem.Name,
-			Size:    *blobItem.Properties.ContentLength,
-			ModTime: *blobItem.Properties.LastModified,
+			Size:    *get.ContentLength,
+			ModTime: *get.LastModified,
 			Uid:     1000,
 			Gid:     1000,
 			Mode:    0600,
 		}
 
-		// Use mutex to protect the tarWriter
-		tarMutex.Lock()
-		if err := tarWriter.WriteHeader(header); err != nil {
-			tarMutex.Unlock()
-			return fmt.Errorf("failed to write tar header for %s: %w", *blobItem.Name, err)
+		var etag *string
+		if get.ETag != nil {
+			s := string(*get.ETag)
+			etag = &s
 		}
-		if _, err := io.Copy(tarWriter, get.Body); err != nil {
-			tarMutex.Unlock()
-			return fmt.Errorf("failed to write blob %s to tar: %w", *blobItem.Name, err)
+		if err := archive.add(header, get.Body, etag); err != nil {
+			return err
 		}
-		tarMutex.Unlock()
 	}
 	return nil
 }
@@ -162,10 +179,11 @@ func (b *BlobArchiver) CopyArchiveToStorageContainer() error {
 
 	ctx := context.Background()
 
+	archiveBlobName := b.destinationBlobName()
 	blockBlobClient, err := blockblob.NewClientFromConnectionString(
 		b.DestinationConnectionString,
 		b.DestinationContainerName,
-		fmt.Sprintf("%s/%s", b.destinationPrefix(), b.TarFile()),
+		archiveBlobName,
 		nil,
 	)
 	if err != nil {
@@ -200,14 +218,58 @@ func (b *BlobArchiver) CopyArchiveToStorageContainer() error {
 	}
 	log.Print("Azure upload complete")
 
+	// the manifest and index are uploaded alongside the archive so they are available to a restore from the
+	// destination container
+	for _, suffix := range sidecarSuffixes {
+		if err := b.uploadSidecar(ctx, tf+suffix, archiveBlobName+suffix); err != nil {
+			return err
+		}
+	}
+
 	// Adding a tag to the blob. This will help if you need to set a lifecycle policy, based on tags. Azure does not have a wildcard
 	// filter in lifecycle management so tags is the best option for filtering
-	_, err = blockBlobClient.SetTags(ctx, b.TarFileTags, &blob.SetTagsOptions{})
+	// the source container and date are always added so the archive can be found by list and restore operations. They
+	// are set last, so prune can take them as the sign the archive and its sidecars were uploaded in full
+	tags := map[string]string{
+		archiveSourceContainerTag: b.ContainerName,
+		archiveDateTag:            b.TimeStr,
+	}
+	for k, v := range b.TarFileTags {
+		tags[k] = v
+	}
+	_, err = blockBlobClient.SetTags(ctx, tags, &blob.SetTagsOptions{})
 	if err != nil {
-		log.Printf("error: unable to add tags. If lifecycle management is enabled, this file may not be included : %v\n", err)
+		return fmt.Errorf("archive uploaded but unable to add tags - prune treats it as incomplete until the upload is rerun : %w", err)
 	}
 	log.Print("tags generated")
 	return nil
+}
+
+// uploadSidecar uploads a file written next to the tar file, if it exists
+func (b *BlobArchiver) uploadSidecar(ctx context.Context, file, blobName string) error {
+	sidecar, err := os.Open(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("no %s found", file)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", file, err)
+	}
+	defer sidecar.Close()
+	sidecarClient, err := blockblob.NewClientFromConnectionString(
+		b.DestinationConnectionString,
+		b.DestinationContainerName,
+		blobName,
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create client for %s: %w", blobName, err)
+	}
+	if _, err := sidecarClient.UploadFile(ctx, sidecar, nil); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", file, err)
+	}
+	log.Printf("%s uploaded", blobName)
+	return nil
 
 }
 
@@ -263,7 +325,7 @@ func (b *BlobArchiver) DownloadBlobToBuffer(
 	}
 	blobClient := containerClient.NewBlobClient(blobName)
 
-	f, err := os.OpenFile(destination, os.O_CREATE|os.O_WRONLY, 0777)
+	f, err := os.OpenFile(destination, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
 	if err != nil {
 		return fmt.Errorf("unable to create destination file [%s]: %v", destination, err)
 	}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 )
 
 func ByteCountSI(b int64) string {
@@ -19,7 +26,6 @@ func ByteCountSI(b int64) string {
 	for n := b / unit; n >= unit; n /= unit {
 		div *= unit
 		exp++
-		fmt.Println(div, exp, unit)
 	}
 	return fmt.Sprintf("%.1f %cB",
 		float64(b)/float64(div), "kMGTPE"[exp])
@@ -84,18 +90,148 @@ func getBasePath(path string) (string, error) {
 	return "", fmt.Errorf("unknown error with path [%s]", path)
 }
 
-func deleteOldArchives(path string, patterns []string) error {
+// archivePatterns are the extensions of the local archives written by backup
+var archivePatterns = []string{"tar", "tgz"}
+
+// localArchive is an archive file found in the backup path
+type localArchive struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// listLocalArchives lists the archives in a path, oldest first
+func listLocalArchives(path string, patterns []string) ([]localArchive, error) {
 	fileList, err := checkForOldArchives(path, patterns)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for i := range fileList {
-		f := fileList[i]
-		log.Printf("found old archive [%s] deleting", f)
-		err = os.Remove(f)
+	var archives []localArchive
+	for _, f := range fileList {
+		info, err := os.Stat(f)
 		if err != nil {
-			return fmt.Errorf("err deleting file %s : %w", f, err)
+			return nil, fmt.Errorf("unable to stat archive %s : %w", f, err)
+		}
+		archives = append(archives, localArchive{path: f, size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i].modTime.Before(archives[j].modTime)
+	})
+	return archives, nil
+}
+
+// removeLocalArchive deletes an archive and its sidecar files
+func removeLocalArchive(f string) error {
+	log.Printf("deleting old archive [%s]", f)
+	if err := os.Remove(f); err != nil {
+		return fmt.Errorf("err deleting file %s : %w", f, err)
+	}
+	for _, suffix := range sidecarSuffixes {
+		sidecar := f + suffix
+		if err := os.Remove(sidecar); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("err deleting file %s : %w", sidecar, err)
 		}
 	}
 	return nil
 }
+
+// makeSpaceForBackup deletes the oldest archives in the path, only while there is not enough free space for a new
+// backup the size of the newest archive. The newest archive is never deleted, as it is the only local copy until the
+// new backup exists. It returns the archives it deleted, even when it fails
+func makeSpaceForBackup(path string, patterns []string) (removed []string, err error) {
+	archives, err := listLocalArchives(path, patterns)
+	if err != nil {
+		return nil, err
+	}
+	if len(archives) == 0 {
+		return nil, nil
+	}
+	basePath, err := getBasePath(path)
+	if err != nil {
+		return nil, err
+	}
+	needed := uint64(archives[len(archives)-1].size)
+	for _, a := range archives[:len(archives)-1] {
+		free, err := freeSpace(basePath)
+		if err != nil {
+			return removed, fmt.Errorf("unable to check free space - no more archives deleted : %w", err)
+		}
+		if free >= needed {
+			log.Printf("[%s] free for a backup of around [%s] - no more archives need deleting", ByteCountSI(int64(free)), ByteCountSI(int64(needed)))
+			return removed, nil
+		}
+		log.Printf("only [%s] free for a backup of around [%s]", ByteCountSI(int64(free)), ByteCountSI(int64(needed)))
+		if err := removeLocalArchive(a.path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, a.path)
+	}
+	free, err := freeSpace(basePath)
+	if err != nil {
+		return removed, fmt.Errorf("unable to check free space : %w", err)
+	}
+	if free < needed {
+		return removed, fmt.Errorf("only [%s] free for a backup of around [%s] with only the newest archive [%s] left",
+			ByteCountSI(int64(free)), ByteCountSI(int64(needed)), archives[len(archives)-1].path)
+	}
+	return removed, nil
+}
+
+// pruneLocalArchives deletes all but the newest keep archives in the path. At least one archive is always kept. It
+// returns the archives it deleted, even when it fails
+func pruneLocalArchives(path string, patterns []string, keep int) (removed []string, err error) {
+	if keep < 1 {
+		return nil, fmt.Errorf("the number of local archives to keep must be at least 1, not [%d]", keep)
+	}
+	archives, err := listLocalArchives(path, patterns)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(archives)-keep; i++ {
+		if err := removeLocalArchive(archives[i].path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, archives[i].path)
+	}
+	return removed, nil
+}
+
+// openTarFile opens a local tar file for reading, decompressing it if required. The returned function closes the file
+func openTarFile(file string, compressed bool) (*tar.Reader, func() error, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open tar file: %w", err)
+	}
+	if !compressed {
+		return tar.NewReader(f), f.Close, nil
+	}
+	gzipReader, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("failed to read compressed tar file %s: %w", file, err)
+	}
+	return tar.NewReader(gzipReader), func() error {
+		gzipReader.Close()
+		return f.Close()
+	}, nil
+}
+
+// openRemoteTarFile streams a tar archive from a blob. Archives ending .tgz are decompressed as they are read
+func openRemoteTarFile(ctx context.Context, containerClient *container.Client, name string) (*tar.Reader, func() error, error) {
+	resp, err := containerClient.NewBlobClient(name).DownloadStream(ctx, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to download archive %s: %w", name, err)
+	}
+	if !strings.HasSuffix(name, ".tgz") {
+		return tar.NewReader(resp.Body), resp.Body.Close, nil
+	}
+	gzipReader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("failed to read compressed archive %s: %w", name, err)
+	}
+	return tar.NewReader(gzipReader), func() error {
+		gzipReader.Close()
+		return resp.Body.Close()
+	}, nil
+}
@@ -11,6 +11,9 @@ import (
 // need a custom type for tags var
 type StringMapFlag map[string]string
 
+// need a custom type for repeatable, comma separated flags such as the include and exclude patterns
+type StringListFlag []string
+
 type BlobArchiver struct {
 	ConnectionString            string
 	ContainerName               string
@@ -26,6 +29,43 @@ type BlobArchiver struct {
 	TimeStr                     string
 	BatchSize                   int
 	Workers                     int
+
+	// operation specific options, set after the archiver is created
+	FailedListFile           string
+	RetryFailedFile          string
+	CreateContainer          bool
+	ApplyContainerProperties bool
+	Staged                   bool
+	StagingContainerName     string
+	Include                  StringListFlag
+	Exclude                  StringListFlag
+	DryRun                   bool
+	ConfirmedContainer       string
+	ProtectedContainers      []string
+	OlderThanDays            int
+	MinSize                  int64
+	MaxSize                  int64
+	TagQuery                 string
+	SkipSafetyBackup         bool
+	SafetyRetentionDays      int
+	DeletedAfter             string
+	DeletedBefore            string
+	Retention                retentionPolicy
+	RemoteTarFile            bool
+	ListShards               int
+	InventoryContainer       string
+	InventoryRule            string
+	InventoryDelta           bool
+	DiffFrom                 string
+	DiffTo                   string
+	ArchiveSourceContainer   string
+	Since                    string
+	Until                    string
+	Entry                    string
+	Catalog                  string
+	CatalogSync              bool
+
+	resumeRestore bool
 }
 
 // NewBlobArchiver initializes a new BlobArchiver instance.
@@ -70,6 +110,11 @@ func (b BlobArchiver) destinationPrefix() string {
 	return fmt.Sprintf("%s/%s", b.TimeStr, b.destinationPath)
 }
 
+// destinationBlobName is the blob the tar file is uploaded to in the destination container
+func (b BlobArchiver) destinationBlobName() string {
+	return fmt.Sprintf("%s/%s", b.destinationPrefix(), b.TarFile())
+}
+
 // TarFile computes the full path to the tar archive file.
 func (b *BlobArchiver) TarFile() string {
 	ext := "tar"
@@ -89,7 +134,10 @@ func (b *BlobArchiver) TarFile() string {
 
 type tarFileStruct struct {
 	Name    string
+	Entry   string
 	Content io.Reader
+	// MD5 of the content, set as the Content-MD5 of the restored blob so it can be verified
+	MD5 []byte
 }
 
 func (b *BlobArchiver) setDestinationTarFile() error {
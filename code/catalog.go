@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	bolt "go.etcd.io/bbolt"
+)
+
+// the catalog is a bbolt file with three buckets. archives holds a catalogArchive for every archive keyed by its
+// location, entries holds a catalogEntry keyed by <entry name>\x00<archive location> so a name or the literal start of
+// a glob can be found with a seek, and archive-entries holds a bucket per archive of its entry names so an archive can
+// be removed without scanning every entry
+var (
+	catalogArchivesBucket       = []byte("archives")
+	catalogEntriesBucket        = []byte("entries")
+	catalogArchiveEntriesBucket = []byte("archive-entries")
+)
+
+// catalogArchive is an archive recorded in the catalog. Location is archive:<blob> for an archive in the destination
+// container or tar:<file> for a local tar file, the same form diff takes
+type catalogArchive struct {
+	Location        string    `json:"location"`
+	Container       string    `json:"container,omitempty"`
+	SourceContainer string    `json:"sourceContainer"`
+	Created         time.Time `json:"created"`
+	Compressed      bool      `json:"compressed"`
+	Entries         int       `json:"entries"`
+}
+
+// catalogEntry is a blob as it was recorded in one archive
+type catalogEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	MD5     string    `json:"md5,omitempty"`
+}
+
+// searchResult is a version of a blob found by search
+type searchResult struct {
+	Name            string    `json:"name"`
+	Size            int64     `json:"size"`
+	ModTime         time.Time `json:"modTime"`
+	MD5             string    `json:"md5,omitempty"`
+	Archive         string    `json:"archive"`
+	SourceContainer string    `json:"sourceContainer"`
+	Archived        time.Time `json:"archived"`
+}
+
+func catalogEntryKey(name, location string) []byte {
+	return []byte(name + "\x00" + location)
+}
+
+// openCatalog opens the catalog file, creating it and its buckets if needed
+func openCatalog(file string) (*bolt.DB, error) {
+	if dir := filepath.Dir(file); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory for catalog: %w", err)
+		}
+	}
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: 30 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open catalog %s: %w", file, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{catalogArchivesBucket, catalogEntriesBucket, catalogArchiveEntriesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to initialise catalog %s: %w", file, err)
+	}
+	return db, nil
+}
+
+// catalogBlobName is the blob the catalog is kept in when it is synced with the destination container
+func (b *BlobArchiver) catalogBlobName() string {
+	return filepath.Base(b.Catalog)
+}
+
+// catalogSyncAttempts is how many times an update is tried when another run changes the synced catalog at the same time
+const catalogSyncAttempts = 5
+
+// catalogPendingFile lists the archives changed in the local catalog that have not been uploaded yet, so a failed upload
+// does not lose them when the synced catalog is next downloaded
+func (b *BlobArchiver) catalogPendingFile() string {
+	return b.Catalog + ".pending.json"
+}
+
+func (b *BlobArchiver) readCatalogPending() (map[string]bool, error) {
+	pending := map[string]bool{}
+	f, err := os.ReadFile(b.catalogPendingFile())
+	if errors.Is(err, fs.ErrNotExist) {
+		return pending, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %w", b.catalogPendingFile(), err)
+	}
+	var locations []string
+	if err := json.Unmarshal(f, &locations); err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", b.catalogPendingFile(), err)
+	}
+	for _, location := range locations {
+		pending[location] = true
+	}
+	return pending, nil
+}
+
+// writeCatalogPending records the archives not uploaded yet, removing the file when there are none
+func (b *BlobArchiver) writeCatalogPending(pending map[string]bool) error {
+	if len(pending) == 0 {
+		err := os.Remove(b.catalogPendingFile())
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var locations []string
+	for location := range pending {
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+	f, err := json.MarshalIndent(locations, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(b.catalogPendingFile(), f, 0600)
+}
+
+// catalogArchiveValues reads the archives bucket, to find the archives an update changes
+func catalogArchiveValues(tx *bolt.Tx) map[string]string {
+	values := map[string]string{}
+	tx.Bucket(catalogArchivesBucket).ForEach(func(k, v []byte) error {
+		values[string(k)] = string(v)
+		return nil
+	})
+	return values
+}
+
+// copyCatalogArchive copies an archive and its entries from one catalog to another. An archive that is not in the
+// source catalog has been removed from it, so nothing is copied
+func copyCatalogArchive(from, to *bolt.Tx, location string) error {
+	value := from.Bucket(catalogArchivesBucket).Get([]byte(location))
+	if value == nil {
+		return nil
+	}
+	if err := to.Bucket(catalogArchivesBucket).Put([]byte(location), value); err != nil {
+		return err
+	}
+	names := from.Bucket(catalogArchiveEntriesBucket).Bucket([]byte(location))
+	if names == nil {
+		return nil
+	}
+	toNames, err := to.Bucket(catalogArchiveEntriesBucket).CreateBucket([]byte(location))
+	if err != nil {
+		return err
+	}
+	fromEntries, toEntries := from.Bucket(catalogEntriesBucket), to.Bucket(catalogEntriesBucket)
+	return names.ForEach(func(name, _ []byte) error {
+		if err := toNames.Put(name, nil); err != nil {
+			return err
+		}
+		key := catalogEntryKey(string(name), location)
+		if value := fromEntries.Get(key); value != nil {
+			return toEntries.Put(key, value)
+		}
+		return nil
+	})
+}
+
+// mergePendingCatalog applies the archives changed in the local catalog but not uploaded yet to a downloaded copy, so
+// replacing the local catalog with it keeps them. Each one is copied from the local catalog, or removed if it was
+// removed there
+func mergePendingCatalog(localFile, downloadedFile string, pending map[string]bool) error {
+	if _, err := os.Stat(localFile); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	local, err := bolt.Open(localFile, 0600, &bolt.Options{Timeout: 30 * time.Second, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("unable to open catalog %s: %w", localFile, err)
+	}
+	defer local.Close()
+	downloaded, err := openCatalog(downloadedFile)
+	if err != nil {
+		return err
+	}
+	err = local.View(func(from *bolt.Tx) error {
+		return downloaded.Update(func(to *bolt.Tx) error {
+			for location := range pending {
+				if err := removeCatalogArchive(to, location); err != nil {
+					return err
+				}
+				if err := copyCatalogArchive(from, to, location); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		downloaded.Close()
+		return fmt.Errorf("unable to merge the local catalog changes: %w", err)
+	}
+	return downloaded.Close()
+}
+
+// downloadCatalog replaces the local catalog with the copy in the destination container, if there is one, keeping the
+// local changes that have not been uploaded yet. It returns the ETag of the copy downloaded, or an empty ETag if there
+// is none, for the upload to be made conditional on
+func (b *BlobArchiver) downloadCatalog(ctx context.Context) (azcore.ETag, error) {
+	containerClient, err := b.createContainerClient(b.DestinationConnectionString, b.DestinationContainerName)
+	if err != nil {
+		return "", fmt.Errorf("failed to create container client: %w", err)
+	}
+	resp, err := containerClient.NewBlobClient(b.catalogBlobName()).DownloadStream(ctx, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		log.Printf("no catalog [%s] in container %s - starting from the local catalog", b.catalogBlobName(), b.DestinationContainerName)
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to download catalog: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// the download is written alongside and renamed so a failure part way through leaves the local catalog intact
+	tmp := b.Catalog + ".download"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", fmt.Errorf("unable to create %s: %w", tmp, err)
+	}
+	if _, err := f.ReadFrom(resp.Body); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", fmt.Errorf("unable to download catalog: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("unable to download catalog: %w", err)
+	}
+	pending, err := b.readCatalogPending()
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := mergePendingCatalog(b.Catalog, tmp, pending); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if len(pending) > 0 {
+		log.Printf("[%d] archives changed in the local catalog since it was last uploaded kept in the downloaded catalog", len(pending))
+	}
+	if err := os.Rename(tmp, b.Catalog); err != nil {
+		return "", err
+	}
+	if resp.ETag == nil {
+		return "", fmt.Errorf("catalog [%s] was downloaded without an ETag", b.catalogBlobName())
+	}
+	return *resp.ETag, nil
+}
+
+// errCatalogChanged is returned when the synced catalog was changed by another run after it was downloaded
+var errCatalogChanged = errors.New("catalog changed in the destination container since it was downloaded")
+
+// uploadCatalog copies the local catalog to the destination container, only if the copy there still has the ETag it
+// was downloaded with, or with an empty ETag only if there is still no copy there
+func (b *BlobArchiver) uploadCatalog(ctx context.Context, etag azcore.ETag) error {
+	f, err := os.Open(b.Catalog)
+	if err != nil {
+		return fmt.Errorf("unable to open catalog: %w", err)
+	}
+	defer f.Close()
+	client, err := blockblob.NewClientFromConnectionString(b.DestinationConnectionString, b.DestinationContainerName, b.catalogBlobName(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create client for %s: %w", b.catalogBlobName(), err)
+	}
+	conditions := &blob.ModifiedAccessConditions{IfMatch: &etag}
+	if etag == "" {
+		conditions = &blob.ModifiedAccessConditions{IfNoneMatch: to.Ptr(azcore.ETagAny)}
+	}
+	_, err = client.UploadFile(ctx, f, &blockblob.UploadFileOptions{
+		AccessConditions: &blob.AccessConditions{ModifiedAccessConditions: conditions},
+	})
+	if bloberror.HasCode(err, bloberror.ConditionNotMet, bloberror.BlobAlreadyExists) {
+		return errCatalogChanged
+	}
+	if err != nil {
+		return fmt.Errorf("failed to upload catalog: %w", err)
+	}
+	log.Printf("catalog uploaded to [%s] in container %s", b.catalogBlobName(), b.DestinationContainerName)
+	return nil
+}
+
+// updateCatalog runs fn in a write transaction on the catalog. With CatalogSync the catalog is downloaded from the
+// destination container first and uploaded again afterwards, only if no other run has uploaded it in between.
+// Otherwise the update is tried again on the new copy, so fn may be called more than once. It does nothing when no
+// catalog is set
+func (b *BlobArchiver) updateCatalog(fn func(tx *bolt.Tx) error) error {
+	if b.Catalog == "" {
+		return nil
+	}
+	ctx := context.Background()
+	for attempt := 1; ; attempt++ {
+		var etag azcore.ETag
+		if b.CatalogSync {
+			var err error
+			if etag, err = b.downloadCatalog(ctx); err != nil {
+				return err
+			}
+		}
+		db, err := openCatalog(b.Catalog)
+		if err != nil {
+			return err
+		}
+		var changed []string
+		err = db.Update(func(tx *bolt.Tx) error {
+			before := catalogArchiveValues(tx)
+			if err := fn(tx); err != nil {
+				return err
+			}
+			after := catalogArchiveValues(tx)
+			for location, value := range before {
+				if after[location] != value {
+					changed = append(changed, location)
+				}
+			}
+			for location := range after {
+				if _, ok := before[location]; !ok {
+					changed = append(changed, location)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			db.Close()
+			return fmt.Errorf("unable to update catalog: %w", err)
+		}
+		if err := db.Close(); err != nil {
+			return fmt.Errorf("unable to update catalog: %w", err)
+		}
+		if !b.CatalogSync {
+			return nil
+		}
+		// the changes are recorded until they are uploaded, so a failed upload does not lose them
+		pending, err := b.readCatalogPending()
+		if err != nil {
+			return err
+		}
+		for _, location := range changed {
+			pending[location] = true
+		}
+		if err := b.writeCatalogPending(pending); err != nil {
+			return fmt.Errorf("unable to record the catalog changes: %w", err)
+		}
+		err = b.uploadCatalog(ctx, etag)
+		if err == nil {
+			return b.writeCatalogPending(nil)
+		}
+		if !errors.Is(err, errCatalogChanged) || attempt == catalogSyncAttempts {
+			return err
+		}
+		log.Printf("%v - updating the new copy, attempt [%d] of [%d]", err, attempt+1, catalogSyncAttempts)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+// removeCatalogArchive deletes an archive and its entries from the catalog
+func removeCatalogArchive(tx *bolt.Tx, location string) error {
+	names := tx.Bucket(catalogArchiveEntriesBucket).Bucket([]byte(location))
+	if names != nil {
+		entries := tx.Bucket(catalogEntriesBucket)
+		err := names.ForEach(func(name, _ []byte) error {
+			return entries.Delete(catalogEntryKey(string(name), location))
+		})
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(catalogArchiveEntriesBucket).DeleteBucket([]byte(location)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(catalogArchivesBucket).Delete([]byte(location))
+}
+
+// catalogBackup records the tar file just written, or with remote the archive blob it was uploaded to, and the entries
+// listed in its manifest. An archive already in the catalog is replaced
+func (b *BlobArchiver) catalogBackup(remote bool) error {
+	if b.Catalog == "" {
+		return nil
+	}
+	manifest, err := readManifest(manifestFile(b.TarFile()))
+	if err != nil {
+		return err
+	}
+	if len(manifest.Entries) == 0 {
+		log.Printf("the manifest of %s does not list its blobs - it is not added to the catalog", b.TarFile())
+		return nil
+	}
+	archive := catalogArchive{
+		Location:        "tar:" + b.TarFile(),
+		SourceContainer: manifest.SourceContainer,
+		Created:         manifest.Created,
+		Compressed:      manifest.Compressed,
+		Entries:         len(manifest.Entries),
+	}
+	if remote {
+		archive.Location = "archive:" + b.destinationBlobName()
+		archive.Container = b.DestinationContainerName
+	}
+
+	err = b.updateCatalog(func(tx *bolt.Tx) error {
+		if err := removeCatalogArchive(tx, archive.Location); err != nil {
+			return err
+		}
+		value, err := json.Marshal(&archive)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(catalogArchivesBucket).Put([]byte(archive.Location), value); err != nil {
+			return err
+		}
+		names, err := tx.Bucket(catalogArchiveEntriesBucket).CreateBucket([]byte(archive.Location))
+		if err != nil {
+			return err
+		}
+		entries := tx.Bucket(catalogEntriesBucket)
+		for _, e := range manifest.Entries {
+			value, err := json.Marshal(&catalogEntry{Size: e.Size, ModTime: e.ModTime, MD5: e.MD5})
+			if err != nil {
+				return err
+			}
+			if err := entries.Put(catalogEntryKey(e.Name, archive.Location), value); err != nil {
+				return err
+			}
+			if err := names.Put([]byte(e.Name), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("[%s] and its [%d] entries added to catalog %s", archive.Location, archive.Entries, b.Catalog)
+	return nil
+}
+
+// uncatalogArchive removes a deleted archive from the catalog
+func (b *BlobArchiver) uncatalogArchive(location string) error {
+	return b.updateCatalog(func(tx *bolt.Tx) error {
+		return removeCatalogArchive(tx, location)
+	})
+}
+
+// uncatalogLocalArchives removes local tar files deleted by housekeeping from the catalog in one update
+func (b *BlobArchiver) uncatalogLocalArchives(files []string) error {
+	if len(files) == 0 {
+		return nil
+	}
+	return b.updateCatalog(func(tx *bolt.Tx) error {
+		for _, f := range files {
+			if err := removeCatalogArchive(tx, "tar:"+f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// globPrefix is the part of a glob before its first wildcard. Every name the glob matches starts with it
+func globPrefix(glob string) string {
+	if i := strings.IndexAny(glob, "*?"); i >= 0 {
+		return glob[:i]
+	}
+	return glob
+}
+
+// SearchCatalog finds every version of the blobs matching the include globs in the archives recorded in the catalog,
+// optionally only in archives of one source container taken within a date range. Results are sorted by name, oldest
+// archive first
+func (b *BlobArchiver) SearchCatalog() ([]searchResult, error) {
+	if b.Catalog == "" {
+		return nil, fmt.Errorf("search needs a catalog (--catalog)")
+	}
+	if len(b.Include) == 0 {
+		return nil, fmt.Errorf("search needs a blob name or glob to look for (--include)")
+	}
+	filter, err := b.entryFilter()
+	if err != nil {
+		return nil, err
+	}
+	var since, until time.Time
+	if b.Since != "" {
+		if since, err = parseArchiveDate(b.Since); err != nil {
+			return nil, err
+		}
+	}
+	if b.Until != "" {
+		if until, err = parseArchiveDate(b.Until); err != nil {
+			return nil, err
+		}
+		// a date on its own includes the whole of that day
+		if len(b.Until) == len("2006-01-02") {
+			until = until.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+	}
+
+	if b.CatalogSync {
+		if _, err := b.downloadCatalog(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := os.Stat(b.Catalog); err != nil {
+		return nil, fmt.Errorf("unable to open catalog: %w", err)
+	}
+	db, err := bolt.Open(b.Catalog, 0600, &bolt.Options{Timeout: 30 * time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open catalog %s: %w", b.Catalog, err)
+	}
+	defer db.Close()
+
+	var results []searchResult
+	err = db.View(func(tx *bolt.Tx) error {
+		archivesBucket := tx.Bucket(catalogArchivesBucket)
+		entries := tx.Bucket(catalogEntriesBucket)
+		if archivesBucket == nil || entries == nil {
+			return fmt.Errorf("%s is not an archive catalog", b.Catalog)
+		}
+		archives := map[string]*catalogArchive{}
+		seen := map[string]bool{}
+		cursor := entries.Cursor()
+		for _, glob := range b.Include {
+			prefix := []byte(globPrefix(glob))
+			for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+				name, location, ok := strings.Cut(string(k), "\x00")
+				if !ok || seen[string(k)] || !filter.Match(name) {
+					continue
+				}
+				seen[string(k)] = true
+
+				archive, ok := archives[location]
+				if !ok {
+					archive = new(catalogArchive)
+					if err := json.Unmarshal(archivesBucket.Get([]byte(location)), archive); err != nil {
+						return fmt.Errorf("unable to read catalog record of %s: %w", location, err)
+					}
+					archives[location] = archive
+				}
+				if b.ArchiveSourceContainer != "" && archive.SourceContainer != b.ArchiveSourceContainer {
+					continue
+				}
+				if (!since.IsZero() && archive.Created.Before(since)) || (!until.IsZero() && archive.Created.After(until)) {
+					continue
+				}
+
+				var e catalogEntry
+				if err := json.Unmarshal(v, &e); err != nil {
+					return fmt.Errorf("unable to read catalog record of [%s] in %s: %w", name, location, err)
+				}
+				results = append(results, searchResult{
+					Name:            name,
+					Size:            e.Size,
+					ModTime:         e.ModTime,
+					MD5:             e.MD5,
+					Archive:         location,
+					SourceContainer: archive.SourceContainer,
+					Archived:        archive.Created,
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Name != results[j].Name {
+			return results[i].Name < results[j].Name
+		}
+		return results[i].Archived.Before(results[j].Archived)
+	})
+	log.Printf("[%d] versions found in catalog %s", len(results), b.Catalog)
+	return results, nil
+}
+
+// writeSearchResults prints the versions found as a table, json or csv
+func writeSearchResults(w io.Writer, results []searchResult, format string) error {
+	if results == nil {
+		results = []searchResult{}
+	}
+	var rows [][]string
+	for _, r := range results {
+		rows = append(rows, []string{r.Name, strconv.FormatInt(r.Size, 10), r.ModTime.Format(time.RFC3339), r.MD5, r.Archive,
+			r.SourceContainer, r.Archived.Format(time.RFC3339)})
+	}
+	header := []string{"name", "size", "modTime", "md5", "archive", "sourceContainer", "archived"}
+	return writeRows(w, format, header, rows, results, func(tw *tabwriter.Writer) {
+		fmt.Fprintln(tw, "NAME\tSIZE\tMODIFIED\tARCHIVED\tARCHIVE")
+		for _, r := range results {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Name, ByteCountSI(r.Size), r.ModTime.Format(time.RFC3339),
+				r.Archived.Format("2006-01-02 15:04"), r.Archive)
+		}
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/linkedin/goavro/v2"
+)
+
+// the change feed is written by Azure to this container when it is enabled on the storage account. Each hour has a
+// segment under idx/segments/YYYY/MM/DD/HHMM/meta.json listing the log directories holding its avro chunks
+const (
+	changeFeedContainer = "$blobchangefeed"
+	changeFeedSegments  = "idx/segments/"
+)
+
+type changeFeedSegment struct {
+	ChunkFilePaths []string `json:"chunkFilePaths"`
+}
+
+// changeFeedEvent is a change to a blob read from the change feed
+type changeFeedEvent struct {
+	Name      string
+	Type      string
+	Time      time.Time
+	Size      int64
+	BlobType  string
+	MediaType string
+}
+
+// avroValue unwraps the value of an avro union, which goavro decodes as a map keyed by the type name
+func avroValue(v any) any {
+	if m, ok := v.(map[string]any); ok && len(m) == 1 {
+		for _, inner := range m {
+			return inner
+		}
+	}
+	return v
+}
+
+func avroString(m map[string]any, key string) string {
+	s, _ := avroValue(m[key]).(string)
+	return s
+}
+
+// changesSince reads the change feed from the hour containing since and returns the blobs under prefix that were
+// created, rewritten or deleted after it, keyed by name. A deleted blob has a nil item
+func (b *BlobArchiver) changesSince(ctx context.Context, since time.Time, prefix string) (map[string]*container.BlobItem, error) {
+	feedClient, err := b.createContainerClient(b.ConnectionString, changeFeedContainer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container client: %w", err)
+	}
+
+	subjectPrefix := "/blobServices/default/containers/" + b.ContainerName + "/blobs/"
+	latest := map[string]changeFeedEvent{}
+	var segments int
+	from := since.UTC().Truncate(time.Hour)
+	for day := from.Truncate(24 * time.Hour); !day.After(time.Now().UTC()); day = day.AddDate(0, 0, 1) {
+		dayPrefix := changeFeedSegments + day.Format("2006/01/02/")
+		pager := feedClient.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: &dayPrefix})
+		for pager.More() {
+			page, err := pager.NextPage(ctx)
+			if bloberror.HasCode(err, bloberror.ContainerNotFound) {
+				return nil, fmt.Errorf("no change feed found - enable the blob change feed on the storage account to use --inventory-delta")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to list change feed segments: %w", err)
+			}
+			for _, blobItem := range page.Segment.BlobItems {
+				segmentTime, err := time.Parse("2006/01/02/1504", strings.TrimSuffix(strings.TrimPrefix(*blobItem.Name, changeFeedSegments), "/meta.json"))
+				if err != nil || segmentTime.Before(from) {
+					continue
+				}
+				segments++
+				if err := readChangeFeedSegment(ctx, feedClient, *blobItem.Name, func(event changeFeedEvent) {
+					if event.Time.Before(since) || !strings.HasPrefix(event.Name, subjectPrefix) {
+						return
+					}
+					event.Name = strings.TrimPrefix(event.Name, subjectPrefix)
+					if !strings.HasPrefix(event.Name, prefix) {
+						return
+					}
+					// events are not guaranteed to be in order, so the newest event for a blob wins
+					if previous, ok := latest[event.Name]; !ok || !event.Time.Before(previous.Time) {
+						latest[event.Name] = event
+					}
+				}); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	changed := map[string]*container.BlobItem{}
+	var deleted int
+	for name, event := range latest {
+		if event.Type == "BlobDeleted" {
+			changed[name] = nil
+			deleted++
+			continue
+		}
+		blobName, lastModified, size := name, event.Time, event.Size
+		item := &container.BlobItem{
+			Name: &blobName,
+			Properties: &container.BlobProperties{
+				ContentLength: &size,
+				LastModified:  &lastModified,
+			},
+		}
+		if event.BlobType != "" {
+			blobType := blob.BlobType(event.BlobType)
+			item.Properties.BlobType = &blobType
+		}
+		if event.MediaType != "" {
+			contentType := event.MediaType
+			item.Properties.ContentType = &contentType
+		}
+		changed[name] = item
+	}
+	log.Printf("change feed: [%d] segments read since %s, [%d] blobs created or changed, [%d] deleted", segments, since.Format(time.RFC3339), len(changed)-deleted, deleted)
+	return changed, nil
+}
+
+// readChangeFeedSegment calls fn for every blob created or deleted in the chunks of a change feed segment
+func readChangeFeedSegment(ctx context.Context, feedClient *container.Client, metaName string, fn func(changeFeedEvent)) error {
+	resp, err := feedClient.NewBlobClient(metaName).DownloadStream(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to download change feed segment %s: %w", metaName, err)
+	}
+	segment := changeFeedSegment{}
+	err = json.NewDecoder(resp.Body).Decode(&segment)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("unable to read change feed segment %s: %w", metaName, err)
+	}
+
+	for _, chunkPath := range segment.ChunkFilePaths {
+		chunkPrefix := strings.TrimPrefix(chunkPath, changeFeedContainer+"/")
+		pager := feedClient.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: &chunkPrefix})
+		for pager.More() {
+			page, err := pager.NextPage(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to list change feed chunks: %w", err)
+			}
+			for _, blobItem := range page.Segment.BlobItems {
+				if err := readChangeFeedChunk(ctx, feedClient, *blobItem.Name, fn); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// readChangeFeedChunk reads one avro chunk of the change feed
+func readChangeFeedChunk(ctx context.Context, feedClient *container.Client, chunkName string, fn func(changeFeedEvent)) error {
+	resp, err := feedClient.NewBlobClient(chunkName).DownloadStream(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to download change feed chunk %s: %w", chunkName, err)
+	}
+	defer resp.Body.Close()
+
+	reader, err := goavro.NewOCFReader(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read change feed chunk %s: %w", chunkName, err)
+	}
+	for reader.Scan() {
+		datum, err := reader.Read()
+		if err != nil {
+			return fmt.Errorf("unable to read change feed chunk %s: %w", chunkName, err)
+		}
+		record, ok := datum.(map[string]any)
+		if !ok {
+			continue
+		}
+		event := changeFeedEvent{
+			Name: avroString(record, "subject"),
+			Type: avroString(record, "eventType"),
+		}
+		if event.Type != "BlobCreated" && event.Type != "BlobDeleted" {
+			continue
+		}
+		if event.Time, err = time.Parse(time.RFC3339Nano, avroString(record, "eventTime")); err != nil {
+			continue
+		}
+		if data, ok := avroValue(record["data"]).(map[string]any); ok {
+			if size, ok := avroValue(data["contentLength"]).(int64); ok {
+				event.Size = size
+			}
+			event.BlobType = avroString(data, "blobType")
+			event.MediaType = avroString(data, "contentType")
+		}
+		fn(event)
+	}
+	return reader.Err()
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// options holds the value of every flag. Most flags set the archiver directly, the rest are only used by main
+type options struct {
+	BlobArchiver
+	KeepLocal int
+	Output    string
+	AsOf      string
+	Listen    string
+	BasicAuth string
+	Profile   string
+}
+
+// newOptions sets the defaults of every flag. The connection strings, container names and any other key set in the
+// configuration file, its selected profile or the environment override the built in defaults
+func newOptions(conf *effectiveConfig) *options {
+	o := &options{
+		BlobArchiver: *NewBlobArchiver(
+			conf.GetSourceAccountConnectString(),
+			conf.GetSourceContainerName(),
+			conf.Prefix,
+			false,
+			"",
+			"",
+			StringMapFlag{},
+			false,
+			conf.GetDestAccountConnectString(),
+			conf.GetDestinationContainerName(),
+			conf.DestinationPath,
+			time.Now().Format("2006-01-02"),
+			25,
+			25,
+		),
+		KeepLocal: 1,
+		Output:    "table",
+		Listen:    "127.0.0.1:8080",
+		Profile:   conf.Name,
+	}
+	o.SafetyRetentionDays = 30
+	o.ListShards = 1
+	o.Retention = retentionPolicy{Daily: 7, Weekly: 4, Monthly: 12}
+	o.ProtectedContainers = conf.GetProtectedContainers()
+	if conf.Compression != nil {
+		o.Compression = *conf.Compression
+	}
+	if conf.Workers != nil {
+		o.Workers = *conf.Workers
+	}
+	if conf.BatchSize != nil {
+		o.BatchSize = *conf.BatchSize
+	}
+	if r := conf.Retention; r != nil {
+		for _, keep := range []struct {
+			value *int
+			flag  *int
+		}{{r.Daily, &o.Retention.Daily}, {r.Weekly, &o.Retention.Weekly}, {r.Monthly, &o.Retention.Monthly}, {r.Yearly, &o.Retention.Yearly}} {
+			if keep.value != nil {
+				*keep.flag = *keep.value
+			}
+		}
+	}
+	return o
+}
+
+// bindFunc defines a flag on a flag set under one of its names. The current value in the options is used as the
+// default, so the short and long names of a flag share both the value and the default
+type bindFunc func(fs *flag.FlagSet, o *options, name, usage string)
+
+func stringFlag(field func(o *options) *string) bindFunc {
+	return func(fs *flag.FlagSet, o *options, name, usage string) {
+		p := field(o)
+		fs.StringVar(p, name, *p, usage)
+	}
+}
+
+func boolFlag(field func(o *options) *bool) bindFunc {
+	return func(fs *flag.FlagSet, o *options, name, usage string) {
+		p := field(o)
+		fs.BoolVar(p, name, *p, usage)
+	}
+}
+
+func intFlag(field func(o *options) *int) bindFunc {
+	return func(fs *flag.FlagSet, o *options, name, usage string) {
+		p := field(o)
+		fs.IntVar(p, name, *p, usage)
+	}
+}
+
+func int64Flag(field func(o *options) *int64) bindFunc {
+	return func(fs *flag.FlagSet, o *options, name, usage string) {
+		p := field(o)
+		fs.Int64Var(p, name, *p, usage)
+	}
+}
+
+func valueFlag(field func(o *options) flag.Value) bindFunc {
+	return func(fs *flag.FlagSet, o *options, name, usage string) {
+		fs.Var(field(o), name, usage)
+	}
+}
+
+// cliFlag is a flag that one or more operations accept
+type cliFlag struct {
+	Short string
+	Long  string
+	Desc  string
+	// bind is nil for a flag that is not parsed by the flag set, such as --yes-i-mean-<container>
+	bind bindFunc
+}
+
+// cliFlags is every flag, in the order they are listed in help
+var cliFlags = []cliFlag{
+	{"c", "connection-string", "Connection string of the source storage account", stringFlag(func(o *options) *string { return &o.ConnectionString })},
+	{"n", "container-name", "Container name", stringFlag(func(o *options) *string { return &o.ContainerName })},
+	{"p", "prefix", "Prefix", stringFlag(func(o *options) *string { return &o.prefix })},
+	{"z", "compression", "Enable compression", boolFlag(func(o *options) *bool { return &o.Compression })},
+	{"P", "path", "Path", stringFlag(func(o *options) *string { return &o.Path })},
+	{"t", "tar-file-name", "Tar file name", stringFlag(func(o *options) *string { return &o.TarFileName })},
+	{"tags", "tar-file-tags", "Comma separated key=value tags to identify and filter the tar file - defaults to Name=BlobArchive", valueFlag(func(o *options) flag.Value { return &o.TarFileTags })},
+	{"o", "overwrite", "Overwrite existing files", boolFlag(func(o *options) *bool { return &o.Overwrite })},
+	{"dc", "destination-connection-string", "Destination connection string", stringFlag(func(o *options) *string { return &o.DestinationConnectionString })},
+	{"dn", "destination-container-name", "Destination container name", stringFlag(func(o *options) *string { return &o.DestinationContainerName })},
+	{"dp", "destination-path", "Destination path", stringFlag(func(o *options) *string { return &o.destinationPath })},
+	{"T", "time", "Timestamp string - defaults to today as YYYY-MM-DD", stringFlag(func(o *options) *string { return &o.TimeStr })},
+	{"b", "batch-size", "Number of blobs each worker is allocated at a time - defaults to 25", intFlag(func(o *options) *int { return &o.BatchSize })},
+	{"w", "workers", "Number of concurrent processes - defaults to 25", intFlag(func(o *options) *int { return &o.Workers })},
+	{"", "failed-list", "File the failed entries of a restore are written to - defaults to <tar file>.failed.json", stringFlag(func(o *options) *string { return &o.FailedListFile })},
+	{"", "retry-failed", "Restore only the entries in a failed entry list written by a previous restore", stringFlag(func(o *options) *string { return &o.RetryFailedFile })},
+	{"", "create-container", "Create the container if it does not exist", boolFlag(func(o *options) *bool { return &o.CreateContainer })},
+	{"", "container-properties", "With --create-container, create the container with the metadata and public access recorded at backup time", boolFlag(func(o *options) *bool { return &o.ApplyContainerProperties })},
+	{"", "staged", "Restore into a staging container, verify it and then promote it to the container with server side copies", boolFlag(func(o *options) *bool { return &o.Staged })},
+	{"", "staging-container", "Staging container for --staged - defaults to <container>-staging", stringFlag(func(o *options) *string { return &o.StagingContainerName })},
+	{"", "include", "Only use names matching these comma separated globs (** matches across /)", valueFlag(func(o *options) flag.Value { return &o.Include })},
+	{"", "exclude", "Do not use names matching these comma separated globs", valueFlag(func(o *options) flag.Value { return &o.Exclude })},
+	{"", "older-than", "Only delete blobs last modified more than this number of days ago", intFlag(func(o *options) *int { return &o.OlderThanDays })},
+	{"", "min-size", "Only delete blobs of at least this many bytes", int64Flag(func(o *options) *int64 { return &o.MinSize })},
+	{"", "max-size", "Only delete blobs of at most this many bytes", int64Flag(func(o *options) *int64 { return &o.MaxSize })},
+	{"", "tag-query", "Only delete blobs matching a blob index tag query, e.g. \"Project\" = 'old'", stringFlag(func(o *options) *string { return &o.TagQuery })},
+	{"", "dry-run", "Show what would be changed without changing anything", boolFlag(func(o *options) *bool { return &o.DryRun })},
+	{"", "yes-i-mean-<container>", "Confirm a delete from <container> without a prompt, for non-interactive use", nil},
+	{"", "skip-safety-backup", "Do not archive the blobs a delete or restore would remove or overwrite before starting", boolFlag(func(o *options) *bool { return &o.SkipSafetyBackup })},
+	{"", "safety-retention-days", "Number of days a safety backup is kept before prune of the same container deletes it - defaults to 30", intFlag(func(o *options) *int { return &o.SafetyRetentionDays })},
+	{"", "deleted-after", "Only undelete blobs deleted at or after this time (YYYY-MM-DD or RFC3339)", stringFlag(func(o *options) *string { return &o.DeletedAfter })},
+	{"", "deleted-before", "Only undelete blobs deleted before this time (YYYY-MM-DD or RFC3339)", stringFlag(func(o *options) *string { return &o.DeletedBefore })},
+	{"", "keep-daily", "Number of daily archives to keep - defaults to 7", intFlag(func(o *options) *int { return &o.Retention.Daily })},
+	{"", "keep-weekly", "Number of weekly archives to keep - defaults to 4", intFlag(func(o *options) *int { return &o.Retention.Weekly })},
+	{"", "keep-monthly", "Number of monthly archives to keep - defaults to 12", intFlag(func(o *options) *int { return &o.Retention.Monthly })},
+	{"", "keep-yearly", "Number of yearly archives to keep - defaults to 0", intFlag(func(o *options) *int { return &o.Retention.Yearly })},
+	{"", "keep-local", "Number of local tar backups to keep in the path, at least 1 - defaults to 1", intFlag(func(o *options) *int { return &o.KeepLocal })},
+	{"", "remote", "The tar file name (-t) is a blob path in the destination container", boolFlag(func(o *options) *bool { return &o.RemoteTarFile })},
+	{"", "entry", "Print this entry of the archive, or extract it under the destination path (-dp)", stringFlag(func(o *options) *string { return &o.Entry })},
+	{"", "list-shards", "Number of top level prefixes listed concurrently - defaults to 1, a single listing", intFlag(func(o *options) *int { return &o.ListShards })},
+	{"", "inventory-container", "Read the blob list from the newest blob inventory report in this container", stringFlag(func(o *options) *string { return &o.InventoryContainer })},
+	{"", "inventory-rule", "Inventory rule name, when the inventory container holds reports for several rules", stringFlag(func(o *options) *string { return &o.InventoryRule })},
+	{"", "inventory-delta", "Apply the changes since the inventory report was taken, read from the blob change feed", boolFlag(func(o *options) *bool { return &o.InventoryDelta })},
+	{"", "from", "Source to compare from - container:<name>, archive:<blob>, tar:<file> or manifest:<file>", stringFlag(func(o *options) *string { return &o.DiffFrom })},
+	{"", "to", "Source to compare to - container:<name>, archive:<blob>, tar:<file> or manifest:<file>", stringFlag(func(o *options) *string { return &o.DiffTo })},
+	{"", "source-container", "Only archives of this source container", stringFlag(func(o *options) *string { return &o.ArchiveSourceContainer })},
+	{"", "since", "Only archives taken on or after a date (YYYY-MM-DD or RFC3339)", stringFlag(func(o *options) *string { return &o.Since })},
+	{"", "until", "Only archives taken on or before a date (YYYY-MM-DD or RFC3339)", stringFlag(func(o *options) *string { return &o.Until })},
+	{"", "catalog", "File of the archive catalog. Backups and uploads are recorded in it and search reads it", stringFlag(func(o *options) *string { return &o.Catalog })},
+	{"", "catalog-sync", "Keep the catalog in the destination container: download it before use and upload it after every update", boolFlag(func(o *options) *bool { return &o.CatalogSync })},
+	{"", "listen", "Address to listen on - defaults to 127.0.0.1:8080", stringFlag(func(o *options) *string { return &o.Listen })},
+	{"", "basic-auth", "Require this user:password", stringFlag(func(o *options) *string { return &o.BasicAuth })},
+	{"", "output", "Output format: table, json or csv - defaults to table", stringFlag(func(o *options) *string { return &o.Output })},
+	{"", "as-of", "Restore the newest archive in the destination container taken on or before a date (YYYY-MM-DD or RFC3339)", stringFlag(func(o *options) *string { return &o.AsOf })},
+	{"", "profile", "Profile of the configuration file to take the defaults from - defaults to $BACKUP_PROFILE", stringFlag(func(o *options) *string { return &o.Profile })},
+}
+
+func findFlag(long string) *cliFlag {
+	for i := range cliFlags {
+		if cliFlags[i].Long == long {
+			return &cliFlags[i]
+		}
+	}
+	return nil
+}
+
+// flag groups shared by several operations
+var (
+	sourceFlags      = []string{"connection-string", "container-name"}
+	destinationFlags = []string{"destination-connection-string", "destination-container-name"}
+	// the tar file name is derived from the container name and time when it is not given
+	tarFileFlags = []string{"container-name", "compression", "path", "tar-file-name", "time"}
+	// an archive is a local tar file or, with --remote, a blob in the destination container
+	archiveFlags = append(append([]string{}, tarFileFlags...), append([]string{"remote"}, destinationFlags...)...)
+	listingFlags = []string{"list-shards", "inventory-container", "inventory-rule", "inventory-delta"}
+	filterFlags  = []string{"include", "exclude"}
+	safetyFlags  = append([]string{"skip-safety-backup", "safety-retention-days"}, destinationFlags...)
+	catalogFlags = append([]string{"catalog", "catalog-sync"}, destinationFlags...)
+)
+
+// command is an operation with the flags it accepts. Required flags must have a value, which may come from the
+// configuration file
+type command struct {
+	Name       string
+	Summary    string
+	Flags      [][]string
+	Required   []string
+	RequiredIf []requirement
+}
+
+// requirement makes flags required only when the other flags given call for them, e.g. by turning on a feature
+type requirement struct {
+	Reason string
+	When   func(fs *flag.FlagSet) bool
+	Flags  []string
+}
+
+// safetyBackupOn is true when the safety backup of a delete will run
+func safetyBackupOn(fs *flag.FlagSet) bool {
+	return !flagSet(fs, "skip-safety-backup") && !flagSet(fs, "dry-run")
+}
+
+// remoteOn is true when the tar file is a blob in the destination container
+func remoteOn(fs *flag.FlagSet) bool {
+	return flagSet(fs, "remote")
+}
+
+// remoteRequirement needs the destination container that a --remote tar file is read from
+var remoteRequirement = requirement{Reason: "to read the tar file with --remote", When: remoteOn, Flags: destinationFlags}
+
+var commands = []command{
+	{
+		Name:     "backup",
+		Summary:  "backup a storage container to a local tar file",
+		Flags:    [][]string{sourceFlags, tarFileFlags, {"batch-size", "workers"}, listingFlags, catalogFlags},
+		Required: []string{"connection-string", "container-name"},
+	},
+	{
+		Name:    "backup-to-container",
+		Summary: "backup to a tar archive file and then copy that file to a storage container",
+		Flags: [][]string{sourceFlags, tarFileFlags, {"tar-file-tags"}, destinationFlags, {"destination-path", "batch-size", "workers", "keep-local"},
+			listingFlags, catalogFlags},
+		Required: []string{"connection-string", "container-name", "destination-connection-string", "destination-container-name"},
+	},
+	{
+		Name:    "restore",
+		Summary: "restore data to a storage container from a backup",
+		Flags: [][]string{sourceFlags, {"prefix"}, tarFileFlags, {"workers", "failed-list", "retry-failed", "create-container", "container-properties",
+			"staged", "staging-container", "as-of", "remote"}, filterFlags, safetyFlags},
+		Required: []string{"connection-string", "container-name"},
+		RequiredIf: []requirement{
+			{Reason: "to find the archive with --as-of", When: func(fs *flag.FlagSet) bool { return flagSet(fs, "as-of") }, Flags: destinationFlags},
+			remoteRequirement,
+		},
+	},
+	{
+		Name:     "download-tarfile",
+		Summary:  "download a tarfile from a storage container to a path",
+		Flags:    [][]string{destinationFlags, {"tar-file-name", "destination-path", "container-name", "compression", "time"}},
+		Required: []string{"destination-connection-string", "destination-container-name", "tar-file-name", "destination-path"},
+	},
+	{
+		Name:     "upload-tarfile",
+		Summary:  "upload a tarfile from a path to a storage container",
+		Flags:    [][]string{tarFileFlags, {"tar-file-tags"}, destinationFlags, {"destination-path", "workers"}, catalogFlags},
+		Required: []string{"container-name", "destination-connection-string", "destination-container-name"},
+	},
+	{
+		Name:    "delete-all-blobs",
+		Summary: "delete all blobs in the source storage container",
+		Flags: [][]string{sourceFlags, {"prefix"}, filterFlags, {"older-than", "min-size", "max-size", "tag-query", "dry-run", "yes-i-mean-<container>",
+			"workers", "compression", "path", "time"}, listingFlags, safetyFlags},
+		Required:   []string{"connection-string", "container-name"},
+		RequiredIf: []requirement{{Reason: "for the safety backup, unless --skip-safety-backup is given", When: safetyBackupOn, Flags: destinationFlags}},
+	},
+	{
+		Name:       "delete-tarfile",
+		Summary:    "delete a tarfile from a path, or from the destination container with --remote",
+		Flags:      [][]string{{"tar-file-name", "remote", "dry-run"}, destinationFlags, {"catalog", "catalog-sync"}},
+		Required:   []string{"tar-file-name"},
+		RequiredIf: []requirement{remoteRequirement},
+	},
+	{
+		Name:     "count",
+		Summary:  "count the files in a storage container and report their total size, broken down by prefix, tier, blob type, content type and size",
+		Flags:    [][]string{sourceFlags, listingFlags, {"output"}},
+		Required: []string{"connection-string", "container-name"},
+	},
+	{
+		Name:       "extract",
+		Summary:    "extract a tarfile to a local directory",
+		Flags:      [][]string{archiveFlags, {"destination-path", "overwrite"}, filterFlags},
+		Required:   []string{"destination-path"},
+		RequiredIf: []requirement{remoteRequirement},
+	},
+	{
+		Name:     "undelete",
+		Summary:  "undelete soft deleted blobs in the source storage container",
+		Flags:    [][]string{sourceFlags, {"prefix"}, filterFlags, {"deleted-after", "deleted-before", "dry-run", "batch-size", "workers"}},
+		Required: []string{"connection-string", "container-name"},
+	},
+	{
+		Name:     "prune",
+		Summary:  "delete archives of the source container from the destination container using a grandfather-father-son retention policy",
+		Flags:    [][]string{{"container-name"}, destinationFlags, {"keep-daily", "keep-weekly", "keep-monthly", "keep-yearly", "dry-run"}, catalogFlags},
+		Required: []string{"container-name", "destination-connection-string", "destination-container-name"},
+	},
+	{
+		Name:     "diff",
+		Summary:  "list the blobs added, removed and changed between two containers, archives, tar files or manifests",
+		Flags:    [][]string{{"from", "to", "connection-string", "prefix", "compression"}, destinationFlags, filterFlags, listingFlags, {"output"}},
+		Required: []string{"from", "to"},
+	},
+	{
+		Name:     "list-archives",
+		Summary:  "list the archives in the destination container with their date, source container, size, compression, tags and manifest",
+		Flags:    [][]string{destinationFlags, {"source-container", "since", "until", "output"}},
+		Required: []string{"destination-connection-string", "destination-container-name"},
+	},
+	{
+		Name:       "inspect",
+		Summary:    "list the entries of a local or remote tar file, or print or extract a single entry",
+		Flags:      [][]string{archiveFlags, filterFlags, {"entry", "destination-path", "overwrite", "output"}},
+		RequiredIf: []requirement{remoteRequirement},
+	},
+	{
+		Name:       "verify",
+		Summary:    "read a local or remote tar file end to end, checking its compression, tar headers and the sizes and checksums recorded in its manifest",
+		Flags:      [][]string{archiveFlags},
+		RequiredIf: []requirement{remoteRequirement},
+	},
+	{
+		Name:     "search",
+		Summary:  "find every archive in the catalog holding a blob name or glob, with the size and modification time of each version",
+		Flags:    [][]string{catalogFlags, filterFlags, {"source-container", "since", "until", "output"}},
+		Required: []string{"catalog", "include"},
+	},
+	{
+		Name:       "serve-archive",
+		Summary:    "browse a local or remote tar file in a web browser and download single entries, read only",
+		Flags:      [][]string{archiveFlags, filterFlags, {"listen", "basic-auth"}},
+		RequiredIf: []requirement{remoteRequirement},
+	},
+	{
+		Name:    "config",
+		Summary: "print the effective configuration of a profile, with secrets masked and where each key was set",
+		Flags:   [][]string{{"profile"}},
+	},
+	{
+		Name:    "completion",
+		Summary: "print a bash or zsh completion script - completion bash|zsh",
+	},
+	{
+		Name:    "help",
+		Summary: "print the options of an operation - help <operation>",
+	},
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].Name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// flagNames is every flag the command accepts, once each, in the order of cliFlags
+func (c *command) flagNames() []string {
+	// every operation with options can take its defaults from a profile
+	accepted := map[string]bool{"profile": len(c.Flags) > 0}
+	for _, group := range c.Flags {
+		for _, name := range group {
+			if findFlag(name) == nil {
+				panic(fmt.Sprintf("operation %s accepts unknown flag %s", c.Name, name))
+			}
+			accepted[name] = true
+		}
+	}
+	var names []string
+	for _, f := range cliFlags {
+		if accepted[f.Long] {
+			names = append(names, f.Long)
+		}
+	}
+	return names
+}
+
+// flagSet defines the flags of the command on a new flag set, binding them to o
+func (c *command) flagSet(o *options) *flag.FlagSet {
+	fs := flag.NewFlagSet(c.Name, flag.ExitOnError)
+	fs.Usage = func() { c.printHelp(fs.Output()) }
+	for _, name := range c.flagNames() {
+		f := findFlag(name)
+		if f.bind == nil {
+			continue
+		}
+		f.bind(fs, o, f.Long, f.Desc)
+		if f.Short != "" {
+			f.bind(fs, o, f.Short, f.Desc)
+		}
+	}
+	return fs
+}
+
+// flagSet is true when the flag has a value, which may come from the configuration file
+func flagSet(fs *flag.FlagSet, name string) bool {
+	value := fs.Lookup(name).Value.String()
+	return value != "" && value != "0" && value != "false"
+}
+
+// missingFlag is the error for a required flag without a value
+func (c *command) missingFlag(name, reason string) error {
+	f := findFlag(name)
+	need := "--" + f.Long
+	if f.Short != "" {
+		need += " (-" + f.Short + ")"
+	}
+	if reason != "" {
+		need += " " + reason
+	}
+	return fmt.Errorf("%s needs %s", c.Name, need)
+}
+
+// validate checks the required flags have a value and that there are no arguments left over
+func (c *command) validate(fs *flag.FlagSet) error {
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument [%s] - %s takes options only", fs.Arg(0), c.Name)
+	}
+	for _, name := range c.Required {
+		if !flagSet(fs, name) {
+			return c.missingFlag(name, "")
+		}
+	}
+	for _, r := range c.RequiredIf {
+		if !r.When(fs) {
+			continue
+		}
+		for _, name := range r.Flags {
+			if !flagSet(fs, name) {
+				return c.missingFlag(name, r.Reason)
+			}
+		}
+	}
+	return nil
+}
+
+func programName() string {
+	return filepath.Base(os.Args[0])
+}
+
+// printHelp prints the operations. The flags of an operation are printed by its own help
+func printHelp(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <operation> [options]\n", programName())
+	fmt.Fprintln(w, "\nOperations:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-20s %s\n", c.Name, c.Summary)
+	}
+	fmt.Fprintf(w, "\nRun '%s <operation> -h' for the options of an operation\n", programName())
+}
+
+// printHelp prints the flags the command accepts, marking the required ones
+func (c *command) printHelp(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s %s [options]\n\n%s\n", programName(), c.Name, c.Summary)
+	names := c.flagNames()
+	if len(names) == 0 {
+		return
+	}
+	required := map[string]string{}
+	for _, r := range c.RequiredIf {
+		for _, name := range r.Flags {
+			if required[name] == "" {
+				required[name] = " (required " + r.Reason + ")"
+			}
+		}
+	}
+	for _, name := range c.Required {
+		required[name] = " (required)"
+	}
+	fmt.Fprintln(w, "\nOptions:")
+	for _, name := range names {
+		f := findFlag(name)
+		short := ""
+		if f.Short != "" {
+			short = "-" + f.Short
+		}
+		desc := f.Desc
+		desc += required[name]
+		fmt.Fprintf(w, "  %-5s %-32s %s\n", short, "--"+f.Long, desc)
+	}
+}
+
+// completionScript writes a bash or zsh completion script that completes the operation and then its flags. Flag
+// values complete as file names
+func completionScript(w io.Writer, shell string) error {
+	name := programName()
+	fn := "_" + strings.NewReplacer("-", "_", ".", "_").Replace(name)
+	var ops []string
+	for _, c := range commands {
+		ops = append(ops, c.Name)
+	}
+	flagWords := func(c *command) string {
+		var words []string
+		for _, long := range c.flagNames() {
+			f := findFlag(long)
+			if f.bind == nil {
+				continue
+			}
+			words = append(words, "--"+f.Long)
+			if f.Short != "" {
+				words = append(words, "-"+f.Short)
+			}
+		}
+		if c.Name == "help" {
+			return strings.Join(ops, " ")
+		}
+		return strings.Join(words, " ")
+	}
+
+	switch shell {
+	case "bash":
+		fmt.Fprintf(w, "%s() {\n", fn)
+		fmt.Fprintln(w, `	local cur=${COMP_WORDS[COMP_CWORD]}`)
+		fmt.Fprintln(w, `	if [ "$COMP_CWORD" -eq 1 ]; then`)
+		fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(ops, " "))
+		fmt.Fprintln(w, "\t\treturn")
+		fmt.Fprintln(w, "\tfi")
+		fmt.Fprintln(w, `	if [[ $cur != -* && ${COMP_WORDS[1]} != help ]]; then`)
+		fmt.Fprintln(w, "\t\treturn")
+		fmt.Fprintln(w, "\tfi")
+		fmt.Fprintln(w, `	case "${COMP_WORDS[1]}" in`)
+		for i := range commands {
+			fmt.Fprintf(w, "\t%s) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", commands[i].Name, flagWords(&commands[i]))
+		}
+		fmt.Fprintln(w, "\tesac")
+		fmt.Fprintln(w, "}")
+		fmt.Fprintf(w, "complete -o default -F %s %s\n", fn, name)
+	case "zsh":
+		fmt.Fprintf(w, "#compdef %s\n\n%s() {\n", name, fn)
+		fmt.Fprintln(w, "\tif (( CURRENT == 2 )); then")
+		fmt.Fprintf(w, "\t\tcompadd -- %s\n", strings.Join(ops, " "))
+		fmt.Fprintln(w, "\t\treturn")
+		fmt.Fprintln(w, "\tfi")
+		fmt.Fprintln(w, `	if [[ $PREFIX != -* && $words[2] != help ]]; then`)
+		fmt.Fprintln(w, "\t\t_files")
+		fmt.Fprintln(w, "\t\treturn")
+		fmt.Fprintln(w, "\tfi")
+		fmt.Fprintln(w, "\tcase $words[2] in")
+		for i := range commands {
+			if words := flagWords(&commands[i]); words != "" {
+				fmt.Fprintf(w, "\t%s) compadd -- %s ;;\n", commands[i].Name, words)
+			}
+		}
+		fmt.Fprintln(w, "\tesac")
+		fmt.Fprintln(w, "}")
+		fmt.Fprintf(w, "\ncompdef %s %s\n", fn, name)
+	default:
+		return fmt.Errorf("unknown shell [%s] - expected bash or zsh", shell)
+	}
+	return nil
+}
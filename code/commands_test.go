@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCommandValidate(t *testing.T) {
+	source := []string{"--connection-string=source", "--container-name=data"}
+	destination := []string{"--destination-connection-string=dest", "--destination-container-name=archives"}
+	args := func(groups ...[]string) []string {
+		var all []string
+		for _, g := range groups {
+			all = append(all, g...)
+		}
+		return all
+	}
+	tests := []struct {
+		name    string
+		command string
+		args    []string
+		// wantErr is part of the error, empty when the flags are valid
+		wantErr string
+	}{
+		{"required flags given", "backup", source, ""},
+		{"required flag missing", "backup", []string{"--connection-string=source"}, "backup needs --container-name"},
+		{"left over argument", "backup", args(source, []string{"extra"}), "unexpected argument [extra]"},
+		{"restore of a local tar file needs no destination", "restore", args(source, []string{"--tar-file-name=a.tar", "--skip-safety-backup"}), ""},
+		{"restore as of a date needs the destination", "restore", args(source, []string{"--as-of=2025-01-01"}),
+			"needs --destination-connection-string"},
+		{"restore as of a date with the destination", "restore", args(source, destination, []string{"--as-of=2025-01-01"}), ""},
+		{"remote restore needs the destination", "restore", args(source, []string{"--tar-file-name=a.tar", "--remote"}),
+			"to read the tar file with --remote"},
+		{"delete needs the destination for the safety backup", "delete-all-blobs", source, "for the safety backup"},
+		{"delete with the safety backup skipped", "delete-all-blobs", args(source, []string{"--skip-safety-backup"}), ""},
+		{"dry run delete takes no safety backup", "delete-all-blobs", args(source, []string{"--dry-run"}), ""},
+		{"delete with the destination", "delete-all-blobs", args(source, destination), ""},
+		{"local tar file deleted without the destination", "delete-tarfile", []string{"--tar-file-name=a.tar"}, ""},
+		{"remote tar file delete needs the destination", "delete-tarfile", []string{"--tar-file-name=a.tar", "--remote"},
+			"to read the tar file with --remote"},
+		{"remote verify with the destination", "verify", args(destination, []string{"--tar-file-name=a.tar", "--remote"}), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := findCommand(tt.command)
+			if c == nil {
+				t.Fatalf("no command [%s]", tt.command)
+			}
+			fs := c.flagSet(newOptions(&effectiveConfig{Source: map[string]string{}}))
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			err := c.validate(fs)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("validate() = %v, want no error", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -2,18 +2,47 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
 
+// profile is a set of defaults for the flags. The top level of the configuration file is a profile, and named
+// profiles under profiles override it. Unset numbers and booleans are nil so they do not override anything
+type profile struct {
+	SourceAccountConnectString string           `yaml:"sourceAccountConnectString,omitempty"`
+	SourceContainerName        string           `yaml:"sourceContainerName,omitempty"`
+	Prefix                     string           `yaml:"prefix,omitempty"`
+	DestAccountConnectString   string           `yaml:"destAccountConnectString,omitempty"`
+	DestinationContainerName   string           `yaml:"destinationContainerName,omitempty"`
+	DestinationPath            string           `yaml:"destinationPath,omitempty"`
+	Compression                *bool            `yaml:"compression,omitempty"`
+	Workers                    *int             `yaml:"workers,omitempty"`
+	BatchSize                  *int             `yaml:"batchSize,omitempty"`
+	Retention                  *retentionConfig `yaml:"retention,omitempty"`
+	ProtectedContainers        []string         `yaml:"protectedContainers,omitempty"`
+}
+
+// retentionConfig is the prune retention policy of a profile
+type retentionConfig struct {
+	Daily   *int `yaml:"daily,omitempty"`
+	Weekly  *int `yaml:"weekly,omitempty"`
+	Monthly *int `yaml:"monthly,omitempty"`
+	Yearly  *int `yaml:"yearly,omitempty"`
+}
+
 type config struct {
-	SourceAccountConnectString string `yaml:"sourceAccountConnectString,omitempty"`
-	SourceContainerName        string `yaml:"sourceContainerName,omitempty"`
-	DestAccountConnectString   string `yaml:"destAccountConnectString,omitempty"`
-	DestinationContainerName   string `yaml:"destinationContainerName,omitempty"`
+	profile  `yaml:",inline"`
+	Profiles map[string]profile `yaml:"profiles,omitempty"`
 }
 
+// envPrefix starts the environment variables that override the configuration, e.g. BACKUP_SOURCE_CONTAINER_NAME
+const envPrefix = "BACKUP_"
+
 func NewConfigFromConfigFile(file string) (*config, error) {
 	conf := new(config)
 	f, err := os.ReadFile(file)
@@ -27,18 +56,254 @@ func NewConfigFromConfigFile(file string) (*config, error) {
 	return conf, nil
 }
 
-func (c *config) GetSourceAccountConnectString() string {
+// configKey is a setting of a profile. Every key can be overridden by the environment variable named after it
+type configKey struct {
+	Name   string
+	Secret bool
+	// quoted is set for strings, so a value such as "true" or "08" is printed as a string
+	quoted bool
+	// list is set for lists that add to the values of the file and profile, rather than replace them
+	list bool
+	get  func(p *profile) string
+	set  func(p *profile, value string) error
+}
+
+// env is the environment variable that overrides the key
+func (k configKey) env() string {
+	var b strings.Builder
+	for _, r := range k.Name {
+		switch {
+		case r == '.':
+			b.WriteRune('_')
+		case r >= 'A' && r <= 'Z':
+			b.WriteRune('_')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r - 'a' + 'A')
+		}
+	}
+	return envPrefix + b.String()
+}
+
+func stringKey(name string, secret bool, field func(p *profile) *string) configKey {
+	return configKey{
+		Name:   name,
+		Secret: secret,
+		quoted: true,
+		get:    func(p *profile) string { return *field(p) },
+		set: func(p *profile, value string) error {
+			*field(p) = value
+			return nil
+		},
+	}
+}
+
+func intKey(name string, field func(p *profile) **int) configKey {
+	return configKey{
+		Name: name,
+		get: func(p *profile) string {
+			if *field(p) == nil {
+				return ""
+			}
+			return strconv.Itoa(**field(p))
+		},
+		set: func(p *profile, value string) error {
+			i, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s must be a number: %w", name, err)
+			}
+			*field(p) = &i
+			return nil
+		},
+	}
+}
+
+// retention returns the retention policy of a profile, adding an empty one if it has none
+func (p *profile) retention() *retentionConfig {
+	if p.Retention == nil {
+		p.Retention = &retentionConfig{}
+	}
+	return p.Retention
+}
+
+// configKeys is every key of a profile, in the order they are printed
+var configKeys = []configKey{
+	stringKey("sourceAccountConnectString", true, func(p *profile) *string { return &p.SourceAccountConnectString }),
+	stringKey("sourceContainerName", false, func(p *profile) *string { return &p.SourceContainerName }),
+	stringKey("prefix", false, func(p *profile) *string { return &p.Prefix }),
+	stringKey("destAccountConnectString", true, func(p *profile) *string { return &p.DestAccountConnectString }),
+	stringKey("destinationContainerName", false, func(p *profile) *string { return &p.DestinationContainerName }),
+	stringKey("destinationPath", false, func(p *profile) *string { return &p.DestinationPath }),
+	{
+		Name: "compression",
+		get: func(p *profile) string {
+			if p.Compression == nil {
+				return ""
+			}
+			return strconv.FormatBool(*p.Compression)
+		},
+		set: func(p *profile, value string) error {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("compression must be true or false: %w", err)
+			}
+			p.Compression = &b
+			return nil
+		},
+	},
+	intKey("workers", func(p *profile) **int { return &p.Workers }),
+	intKey("batchSize", func(p *profile) **int { return &p.BatchSize }),
+	intKey("retention.daily", func(p *profile) **int { return &p.retention().Daily }),
+	intKey("retention.weekly", func(p *profile) **int { return &p.retention().Weekly }),
+	intKey("retention.monthly", func(p *profile) **int { return &p.retention().Monthly }),
+	intKey("retention.yearly", func(p *profile) **int { return &p.retention().Yearly }),
+	{
+		Name: "protectedContainers",
+		list: true,
+		get:  func(p *profile) string { return strings.Join(p.ProtectedContainers, ",") },
+		set: func(p *profile, value string) error {
+			p.ProtectedContainers = nil
+			seen := map[string]bool{}
+			for _, name := range strings.Split(value, ",") {
+				if name = strings.TrimSpace(name); name != "" && !seen[name] {
+					seen[name] = true
+					p.ProtectedContainers = append(p.ProtectedContainers, name)
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// effectiveConfig is the profile the flags default to, with where each key came from
+type effectiveConfig struct {
+	profile
+	Name   string
+	Source map[string]string
+}
+
+// resolve merges the named profile over the top level of the file, then applies the environment variable overrides.
+// A list key, such as the protected containers, is the union of every source, so a profile or the environment can
+// never unprotect a container. An empty name uses the top level only
+func (c *config) resolve(name string) (*effectiveConfig, error) {
+	e := &effectiveConfig{Name: name, Source: map[string]string{}}
+	// add sets a key, or adds to the values a list key already has
+	add := func(k configKey, value, source string) error {
+		if k.list {
+			if existing := k.get(&e.profile); existing != "" {
+				value = existing + "," + value
+				source = e.Source[k.Name] + ", " + source
+			}
+		}
+		if err := k.set(&e.profile, value); err != nil {
+			return err
+		}
+		e.Source[k.Name] = source
+		return nil
+	}
+	// the keys are copied one at a time so the file and profile values never share the retention policy
+	merge := func(p *profile, source string) {
+		for _, k := range configKeys {
+			if value := k.get(p); value != "" {
+				add(k, value, source)
+			}
+		}
+	}
+	merge(&c.profile, "file")
+	if name != "" {
+		p, ok := c.Profiles[name]
+		if !ok {
+			var names []string
+			for n := range c.Profiles {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("no profile [%s] in the configuration file - profiles are [%s]", name, strings.Join(names, ", "))
+		}
+		merge(&p, "profile "+name)
+	}
+	for _, k := range configKeys {
+		value, ok := os.LookupEnv(k.env())
+		// an empty list adds nothing, so it is ignored rather than clearing the list
+		if !ok || (k.list && strings.Trim(value, ", ") == "") {
+			continue
+		}
+		if err := add(k, value, k.env()); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", k.env(), err)
+		}
+	}
+	return e, nil
+}
+
+// maskConnectionString hides the account key or SAS token of a connection string, keeping the account name and
+// endpoints so it can still be recognised
+func maskConnectionString(s string) string {
+	parts := strings.Split(s, ";")
+	for i, part := range parts {
+		key, _, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "accountkey", "sharedaccesssignature":
+			parts[i] = key + "=****"
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// Write prints the effective configuration as YAML, with secrets masked and where each key was set as a comment
+func (e *effectiveConfig) Write(w io.Writer) {
+	if e.Name != "" {
+		fmt.Fprintf(w, "# profile: %s\n", e.Name)
+	}
+	section := ""
+	for _, k := range configKeys {
+		value := k.get(&e.profile)
+		if value == "" {
+			continue
+		}
+		if k.Secret {
+			value = maskConnectionString(value)
+		}
+		name := k.Name
+		if parent, child, ok := strings.Cut(k.Name, "."); ok {
+			if section != parent {
+				fmt.Fprintf(w, "%s:\n", parent)
+				section = parent
+			}
+			name = "  " + child
+		}
+		if k.Name == "protectedContainers" {
+			fmt.Fprintf(w, "%s:  # %s\n", name, e.Source[k.Name])
+			for _, c := range e.ProtectedContainers {
+				fmt.Fprintf(w, "  - %s\n", c)
+			}
+			continue
+		}
+		if k.quoted {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(w, "%s: %s  # %s\n", name, value, e.Source[k.Name])
+	}
+}
+
+func (c *profile) GetSourceAccountConnectString() string {
 	return c.SourceAccountConnectString
 }
 
-func (c *config) GetSourceContainerName() string {
+func (c *profile) GetSourceContainerName() string {
 	return c.SourceContainerName
 }
 
-func (c *config) GetDestAccountConnectString() string {
+func (c *profile) GetDestAccountConnectString() string {
 	return c.DestAccountConnectString
 }
 
-func (c *config) GetDestinationContainerName() string {
+func (c *profile) GetDestinationContainerName() string {
 	return c.DestinationContainerName
 }
+
+func (c *profile) GetProtectedContainers() []string {
+	return c.ProtectedContainers
+}
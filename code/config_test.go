@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const testConfig = `
+sourceContainerName: file-source
+prefix: file-prefix
+workers: 4
+retention:
+  daily: 7
+  weekly: 4
+protectedContainers: [prod, shared]
+profiles:
+  nightly:
+    sourceContainerName: nightly-source
+    workers: 8
+    retention:
+      daily: 14
+    protectedContainers: [shared, nightly]
+`
+
+func TestConfigResolve(t *testing.T) {
+	tests := []struct {
+		name      string
+		profile   string
+		env       map[string]string
+		want      map[string]string
+		sources   map[string]string
+		protected []string
+		wantErr   bool
+	}{
+		{
+			name:      "file only",
+			want:      map[string]string{"sourceContainerName": "file-source", "workers": "4", "retention.daily": "7"},
+			sources:   map[string]string{"sourceContainerName": "file", "workers": "file"},
+			protected: []string{"prod", "shared"},
+		},
+		{
+			name:    "profile overrides the file",
+			profile: "nightly",
+			want: map[string]string{"sourceContainerName": "nightly-source", "prefix": "file-prefix", "workers": "8",
+				"retention.daily": "14", "retention.weekly": "4"},
+			sources: map[string]string{"sourceContainerName": "profile nightly", "prefix": "file",
+				"retention.daily": "profile nightly", "retention.weekly": "file", "protectedContainers": "file, profile nightly"},
+			protected: []string{"prod", "shared", "nightly"},
+		},
+		{
+			name:    "environment overrides the profile",
+			profile: "nightly",
+			env: map[string]string{"BACKUP_SOURCE_CONTAINER_NAME": "env-source", "BACKUP_RETENTION_DAILY": "30",
+				"BACKUP_PROTECTED_CONTAINERS": "nightly, audit"},
+			want:      map[string]string{"sourceContainerName": "env-source", "workers": "8", "retention.daily": "30"},
+			sources:   map[string]string{"sourceContainerName": "BACKUP_SOURCE_CONTAINER_NAME", "workers": "profile nightly"},
+			protected: []string{"prod", "shared", "nightly", "audit"},
+		},
+		{
+			name:      "an empty protected list adds nothing",
+			env:       map[string]string{"BACKUP_PROTECTED_CONTAINERS": " , "},
+			protected: []string{"prod", "shared"},
+		},
+		{
+			name:    "unknown profile",
+			profile: "weekly",
+			wantErr: true,
+		},
+		{
+			name:    "invalid number",
+			env:     map[string]string{"BACKUP_WORKERS": "many"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range configKeys {
+				t.Setenv(k.env(), "")
+				os.Unsetenv(k.env())
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			c := new(config)
+			if err := yaml.Unmarshal([]byte(testConfig), c); err != nil {
+				t.Fatal(err)
+			}
+			e, err := c.resolve(tt.profile)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, k := range configKeys {
+				if want, ok := tt.want[k.Name]; ok && k.get(&e.profile) != want {
+					t.Errorf("%s = %q, want %q", k.Name, k.get(&e.profile), want)
+				}
+				if want, ok := tt.sources[k.Name]; ok && e.Source[k.Name] != want {
+					t.Errorf("%s set by %q, want %q", k.Name, e.Source[k.Name], want)
+				}
+			}
+			if !slices.Equal(e.ProtectedContainers, tt.protected) {
+				t.Errorf("protectedContainers = %v, want %v", e.ProtectedContainers, tt.protected)
+			}
+			// the file must not be changed by resolving a profile
+			if *c.Retention.Daily != 7 || len(c.ProtectedContainers) != 2 {
+				t.Errorf("resolve changed the file settings")
+			}
+		})
+	}
+}
@@ -1,10 +1,23 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 )
 
+// container names are 3 to 63 lowercase letters, numbers and single dashes, starting and ending with a letter or number
+var containerNameRegexp = regexp.MustCompile(`^[a-z0-9](?:-?[a-z0-9])*$`)
+
+func isValidContainerName(name string) bool {
+	return len(name) >= 3 && len(name) <= 63 && containerNameRegexp.MatchString(name)
+}
+
 // createContainerClient creates a container client.
 func (b *BlobArchiver) createContainerClient(connectionString, containerName string) (*container.Client, error) {
 	client, err := azblob.NewClientFromConnectionString(connectionString, nil)
@@ -13,3 +26,64 @@ func (b *BlobArchiver) createContainerClient(connectionString, containerName str
 	}
 	return client.ServiceClient().NewContainerClient(containerName), nil
 }
+
+// listBlobs lists the blobs in a container under a prefix, keyed by blob name
+func listBlobs(ctx context.Context, containerClient *container.Client, prefix string) (map[string]*container.BlobItem, error) {
+	blobs := map[string]*container.BlobItem{}
+	pager := containerClient.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+		Prefix:  &prefix,
+		Include: container.ListBlobsInclude{Copy: true},
+	})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list blobs: %w", err)
+		}
+		for _, blobItem := range page.Segment.BlobItems {
+			blobs[*blobItem.Name] = blobItem
+		}
+	}
+	return blobs, nil
+}
+
+// createContainerIfMissing creates the source container if it does not exist. If props is set, the container is
+// created with the metadata and public access level recorded at backup time
+func (b *BlobArchiver) createContainerIfMissing(ctx context.Context, props *containerProperties) error {
+	containerClient, err := b.createContainerClient(b.ConnectionString, b.ContainerName)
+	if err != nil {
+		return fmt.Errorf("failed to create container client: %w", err)
+	}
+	_, err = containerClient.GetProperties(ctx, nil)
+	if err == nil {
+		log.Printf("container %s already exists", b.ContainerName)
+		return nil
+	}
+	if !bloberror.HasCode(err, bloberror.ContainerNotFound) {
+		return fmt.Errorf("unable to check if container %s exists: %w", b.ContainerName, err)
+	}
+
+	if !isValidContainerName(b.ContainerName) {
+		return fmt.Errorf("refusing to create container [%s] - container names must be 3 to 63 lowercase letters, numbers and single dashes, starting and ending with a letter or number", b.ContainerName)
+	}
+
+	options := &container.CreateOptions{}
+	if props != nil {
+		options.Metadata = map[string]*string{}
+		for k, v := range props.Metadata {
+			options.Metadata[k] = &v
+		}
+		if props.PublicAccess != "" {
+			access := container.PublicAccessType(props.PublicAccess)
+			options.Access = &access
+		}
+	}
+	_, err = containerClient.Create(ctx, options)
+	if bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create container %s: %w", b.ContainerName, err)
+	}
+	log.Printf("created container %s", b.ContainerName)
+	return nil
+}
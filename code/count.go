@@ -3,32 +3,193 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 )
 
-// CountBlobs counts the number of blobs in a container
-func (b *BlobArchiver) CountBlobs() (int64, error) {
-	ctx := context.Background()
+// sizeBuckets are the upper bounds of the size histogram buckets - the last bucket holds everything larger
+var sizeBuckets = []struct {
+	name  string
+	limit int64
+}{
+	{"< 1 kB", 1000},
+	{"< 1 MB", 1000 * 1000},
+	{"< 10 MB", 10 * 1000 * 1000},
+	{"< 100 MB", 100 * 1000 * 1000},
+	{"< 1 GB", 1000 * 1000 * 1000},
+	{">= 1 GB", -1},
+}
 
-	containerClient, err := b.createContainerClient(b.ConnectionString, b.ContainerName)
-	if err != nil {
-		return 0, fmt.Errorf("failed to create container client: %w", err)
+// inventoryCount is the number and total size of the blobs in one breakdown
+type inventoryCount struct {
+	Count int64 `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+// containerInventory summarises every blob in a container
+type containerInventory struct {
+	Container  string                               `json:"container"`
+	Count      int64                                `json:"count"`
+	Bytes      int64                                `json:"bytes"`
+	Oldest     *time.Time                           `json:"oldest,omitempty"`
+	Newest     *time.Time                           `json:"newest,omitempty"`
+	Breakdowns map[string]map[string]inventoryCount `json:"breakdowns"`
+}
+
+// the breakdowns in the order they are printed
+var inventoryBreakdowns = []string{"prefix", "tier", "type", "contentType", "size"}
+
+func newContainerInventory(containerName string) *containerInventory {
+	inv := &containerInventory{
+		Container:  containerName,
+		Breakdowns: map[string]map[string]inventoryCount{},
+	}
+	for _, breakdown := range inventoryBreakdowns {
+		inv.Breakdowns[breakdown] = map[string]inventoryCount{}
 	}
+	return inv
+}
 
-	var counter int64 = 0
-	var pagecounter int64 = 0
-	pager := containerClient.NewListBlobsFlatPager(nil)
+func (inv *containerInventory) add(blobItem *container.BlobItem) {
+	p := blobItem.Properties
+	var size int64
+	if p.ContentLength != nil {
+		size = *p.ContentLength
+	}
+	inv.Count++
+	inv.Bytes += size
 
-	for pager.More() {
+	if p.LastModified != nil {
+		if inv.Oldest == nil || p.LastModified.Before(*inv.Oldest) {
+			inv.Oldest = p.LastModified
+		}
+		if inv.Newest == nil || p.LastModified.After(*inv.Newest) {
+			inv.Newest = p.LastModified
+		}
+	}
 
-		pagecounter++
-		page, err := pager.NextPage(ctx)
-		if err != nil {
-			return 0, fmt.Errorf("failed to list blobs: %w", err)
+	prefix := "(none)"
+	if i := strings.Index(*blobItem.Name, "/"); i >= 0 {
+		prefix = (*blobItem.Name)[:i+1]
+	}
+	tier := "(unknown)"
+	if p.AccessTier != nil {
+		tier = string(*p.AccessTier)
+	}
+	blobType := "(unknown)"
+	if p.BlobType != nil {
+		blobType = string(*p.BlobType)
+	}
+	contentType := "(none)"
+	if p.ContentType != nil && *p.ContentType != "" {
+		contentType = *p.ContentType
+	}
+	bucket := sizeBuckets[len(sizeBuckets)-1].name
+	for _, b := range sizeBuckets {
+		if b.limit > 0 && size < b.limit {
+			bucket = b.name
+			break
 		}
-		for range page.Segment.BlobItems {
-			counter++
+	}
+
+	for breakdown, key := range map[string]string{
+		"prefix":      prefix,
+		"tier":        tier,
+		"type":        blobType,
+		"contentType": contentType,
+		"size":        bucket,
+	} {
+		c := inv.Breakdowns[breakdown][key]
+		c.Count++
+		c.Bytes += size
+		inv.Breakdowns[breakdown][key] = c
+	}
+}
+
+// sortedKeys returns the keys of a breakdown, largest first. The size histogram keeps the bucket order
+func (inv *containerInventory) sortedKeys(breakdown string) []string {
+	if breakdown == "size" {
+		var keys []string
+		for _, b := range sizeBuckets {
+			if _, ok := inv.Breakdowns[breakdown][b.name]; ok {
+				keys = append(keys, b.name)
+			}
+		}
+		return keys
+	}
+	counts := inv.Breakdowns[breakdown]
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]].Bytes == counts[keys[j]].Bytes {
+			return keys[i] < keys[j]
+		}
+		return counts[keys[i]].Bytes > counts[keys[j]].Bytes
+	})
+	return keys
+}
+
+// Write prints the inventory as a table, json or csv
+func (inv *containerInventory) Write(w io.Writer, format string) error {
+	rows := [][]string{{"total", inv.Container, strconv.FormatInt(inv.Count, 10), strconv.FormatInt(inv.Bytes, 10)}}
+	if inv.Oldest != nil {
+		rows = append(rows, []string{"lastModified", "oldest", inv.Oldest.Format(time.RFC3339), ""},
+			[]string{"lastModified", "newest", inv.Newest.Format(time.RFC3339), ""})
+	}
+	for _, breakdown := range inventoryBreakdowns {
+		for _, key := range inv.sortedKeys(breakdown) {
+			c := inv.Breakdowns[breakdown][key]
+			rows = append(rows, []string{breakdown, key, strconv.FormatInt(c.Count, 10), strconv.FormatInt(c.Bytes, 10)})
+		}
+	}
+	return writeRows(w, format, []string{"breakdown", "key", "count", "bytes"}, rows, inv, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "container\t%s\n", inv.Container)
+		fmt.Fprintf(tw, "blobs\t%d\n", inv.Count)
+		fmt.Fprintf(tw, "size\t%s\n", ByteCountSI(inv.Bytes))
+		if inv.Oldest != nil {
+			fmt.Fprintf(tw, "oldest\t%s\n", inv.Oldest.Format(time.RFC3339))
+			fmt.Fprintf(tw, "newest\t%s\n", inv.Newest.Format(time.RFC3339))
 		}
-		fmt.Printf("[page : %d][count : %d]\n", pagecounter, counter)
+		for _, breakdown := range inventoryBreakdowns {
+			fmt.Fprintf(tw, "\n%s\tblobs\tsize\n", breakdown)
+			for _, key := range inv.sortedKeys(breakdown) {
+				c := inv.Breakdowns[breakdown][key]
+				fmt.Fprintf(tw, "  %s\t%d\t%s\n", key, c.Count, ByteCountSI(c.Bytes))
+			}
+		}
+	})
+}
+
+// InventoryBlobs pages through every blob in a container, counting them and breaking them down by top level prefix,
+// access tier, blob type, content type and size
+func (b *BlobArchiver) InventoryBlobs() (*containerInventory, error) {
+	ctx := context.Background()
+
+	containerClient, err := b.createContainerClient(b.ConnectionString, b.ContainerName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container client: %w", err)
+	}
+
+	inv := newContainerInventory(b.ContainerName)
+	err = b.forEachBlob(ctx, containerClient, "", container.ListBlobsInclude{}, func(blobItem *container.BlobItem) error {
+		inv.add(blobItem)
+		if inv.Count%int64(maxListResults) == 0 {
+			log.Printf("[count : %d]\n", inv.Count)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return counter, nil
+	log.Printf("[count : %d]\n", inv.Count)
+	return inv, nil
 }
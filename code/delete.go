@@ -1,25 +1,129 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"log"
 	"os"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 	"github.com/schollz/progressbar/v3"
 )
 
+// failed delete sub-requests are retried this many times, backing off exponentially from deleteRetryDelay
+const (
+	deleteRetries    = 4
+	deleteRetryDelay = time.Second
+)
+
+// batchProcessor is a batch of blobs to delete. With etags, each blob is only deleted if it is unchanged
 type batchProcessor struct {
-	batch *container.BatchBuilder
-	count int
+	names []string
+	etags map[string]string
 }
 
-func NewBatchProcessor(batch *container.BatchBuilder, batchLen int) *batchProcessor {
+func NewBatchProcessor(names []string, etags map[string]string) *batchProcessor {
 	return &batchProcessor{
-		batch: batch,
-		count: batchLen,
+		names: names,
+		etags: etags,
+	}
+}
+
+// deleteSummary counts the outcome of every blob a delete was asked to remove
+type deleteSummary struct {
+	deleted atomic.Int64
+	skipped atomic.Int64
+	changed atomic.Int64
+	failed  atomic.Int64
+}
+
+// submitDeleteBatch deletes the named blobs in a single batch request. With etags, a blob is only deleted if it still
+// has the ETag it was archived with, and a blob changed since is counted rather than deleted. Blobs that no longer
+// exist are skipped, the error for every other failed sub-request is returned keyed by blob name
+func submitDeleteBatch(ctx context.Context, containerClient *container.Client, names []string, etags map[string]string) (deleted, skipped, changed int, failed map[string]error) {
+	failed = map[string]error{}
+	batch, err := containerClient.NewBatchBuilder()
+	if err != nil {
+		for _, name := range names {
+			failed[name] = fmt.Errorf("failed to build batch: %w", err)
+		}
+		return 0, 0, 0, failed
+	}
+	for _, name := range names {
+		var options *container.BatchDeleteOptions
+		if etags != nil {
+			etag := azcore.ETag(etags[name])
+			options = &container.BatchDeleteOptions{DeleteOptions: blob.DeleteOptions{
+				AccessConditions: &blob.AccessConditions{ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfMatch: &etag}},
+			}}
+		}
+		if err := batch.Delete(name, options); err != nil {
+			failed[name] = fmt.Errorf("add delete request to batch: %w", err)
+		}
+	}
+	r, err := containerClient.SubmitBatch(ctx, batch, nil)
+	if err != nil {
+		for _, name := range names {
+			failed[name] = fmt.Errorf("failed to submit batch: %w", err)
+		}
+		return 0, 0, 0, failed
+	}
+	for _, resp := range r.Responses {
+		switch {
+		case resp.Error == nil:
+			deleted++
+		case bloberror.HasCode(resp.Error, bloberror.BlobNotFound):
+			skipped++
+		case bloberror.HasCode(resp.Error, bloberror.ConditionNotMet):
+			changed++
+			if resp.BlobName != nil {
+				log.Printf("skipped %s - changed since it was checked or archived", *resp.BlobName)
+			}
+		case resp.BlobName != nil:
+			failed[*resp.BlobName] = resp.Error
+		case resp.ContentID != nil && *resp.ContentID < len(names):
+			failed[names[*resp.ContentID]] = resp.Error
+		default:
+			log.Printf("delete sub-request failed for an unknown blob: %v", resp.Error)
+		}
+	}
+	return deleted, skipped, changed, failed
+}
+
+// deleteWithRetry deletes a batch of blobs, retrying the sub-requests that fail with an exponential backoff
+func deleteWithRetry(ctx context.Context, containerClient *container.Client, names []string, etags map[string]string, summary *deleteSummary, bar *progressbar.ProgressBar) {
+	delay := deleteRetryDelay
+	for attempt := 0; ; attempt++ {
+		deleted, skipped, changed, failed := submitDeleteBatch(ctx, containerClient, names, etags)
+		summary.deleted.Add(int64(deleted))
+		summary.skipped.Add(int64(skipped))
+		summary.changed.Add(int64(changed))
+		bar.Add(deleted)
+		if len(failed) == 0 {
+			return
+		}
+		if attempt == deleteRetries || ctx.Err() != nil {
+			for name, err := range failed {
+				log.Printf("failed to delete %s: %v", name, err)
+			}
+			summary.failed.Add(int64(len(failed)))
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+		names = names[:0]
+		for name := range failed {
+			names = append(names, name)
+		}
 	}
 }
 
@@ -51,23 +155,281 @@ func (b *BlobArchiver) DeleteAllBlobs() error {
 	return nil
 }
 
-// deleteTarFile deletes the tar archive file.
+// deleteTarFile deletes the tar archive file, and its manifest and index, from the local path or the destination
+// container.
 func (b *BlobArchiver) DeleteTarFile() error {
-	if err := os.Remove(b.TarFileName); err != nil {
+	if b.RemoteTarFile {
+		return b.deleteRemoteTarFile(context.Background())
+	}
+	if b.DryRun {
+		log.Printf("dry run: would delete tar file %s and its manifest and index", b.TarFileName)
+		return nil
+	}
+	if err := removeLocalArchive(b.TarFileName); err != nil {
 		return fmt.Errorf("failed to delete tar file %s: %w", b.TarFileName, err)
 	}
 	fmt.Printf("Deleted tar file: %s\n", b.TarFileName)
+	if err := b.uncatalogArchive("tar:" + b.TarFileName); err != nil {
+		log.Printf("unable to remove %s from the catalog: %v", b.TarFileName, err)
+	}
+	return nil
+}
+
+// deleteRemoteTarFile deletes an archive blob and its manifest and index from the destination container. Archives
+// under a legal hold or an unexpired immutability policy are refused rather than left to fail part way through
+func (b *BlobArchiver) deleteRemoteTarFile(ctx context.Context) error {
+	if b.DestinationConnectionString == "" || b.DestinationContainerName == "" {
+		return fmt.Errorf("destination connection string or container name not provided")
+	}
+	containerClient, err := b.createContainerClient(b.DestinationConnectionString, b.DestinationContainerName)
+	if err != nil {
+		return fmt.Errorf("failed to create container client: %w", err)
+	}
+
+	blobs := []string{b.TarFileName}
+	for _, suffix := range sidecarSuffixes {
+		blobs = append(blobs, b.TarFileName+suffix)
+	}
+	var found []string
+	for i, name := range blobs {
+		props, err := containerClient.NewBlobClient(name).GetProperties(ctx, nil)
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			// only the archive itself has to exist
+			if i == 0 {
+				return fmt.Errorf("archive %s not found in container %s", name, b.DestinationContainerName)
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to get properties of %s: %w", name, err)
+		}
+		if props.LegalHold != nil && *props.LegalHold {
+			return fmt.Errorf("refusing to delete %s - it is under a legal hold", name)
+		}
+		if props.ImmutabilityPolicyExpiresOn != nil && props.ImmutabilityPolicyExpiresOn.After(time.Now()) {
+			return fmt.Errorf("refusing to delete %s - it is immutable until %s", name, props.ImmutabilityPolicyExpiresOn.Format(time.RFC3339))
+		}
+		found = append(found, name)
+	}
+
+	if b.DryRun {
+		for _, name := range found {
+			log.Printf("dry run: would delete [%s] from container %s", name, b.DestinationContainerName)
+		}
+		return nil
+	}
+	if err := deleteArchiveBlobs(ctx, containerClient, b.TarFileName); err != nil {
+		return fmt.Errorf("failed to delete archive %s: %w", b.TarFileName, err)
+	}
+	for _, name := range found {
+		log.Printf("deleted [%s] from container %s", name, b.DestinationContainerName)
+	}
+	if err := b.uncatalogArchive("archive:" + b.TarFileName); err != nil {
+		log.Printf("unable to remove %s from the catalog: %v", b.TarFileName, err)
+	}
+	return nil
+}
+
+// confirmDeletePrefix is the start of the flag that confirms a delete in non-interactive mode, e.g. --yes-i-mean-mycontainer
+const confirmDeletePrefix = "yes-i-mean-"
+
+// isInteractive reports whether stdin is a terminal that can answer a prompt
+func isInteractive() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// confirmDelete refuses to delete from a protected container and otherwise requires the container name to be typed
+// back, or passed with --yes-i-mean-<container> when there is no terminal to prompt on
+func (b *BlobArchiver) confirmDelete() error {
+	if slices.Contains(b.ProtectedContainers, b.ContainerName) {
+		return fmt.Errorf("container %s is protected in the configuration file - refusing to delete from it", b.ContainerName)
+	}
+	if b.ConfirmedContainer != "" {
+		if b.ConfirmedContainer != b.ContainerName {
+			return fmt.Errorf("--%s%s does not match container %s", confirmDeletePrefix, b.ConfirmedContainer, b.ContainerName)
+		}
+		return nil
+	}
+	if !isInteractive() {
+		return fmt.Errorf("refusing to delete from container %s without confirmation - pass --%s%s to run non-interactively",
+			b.ContainerName, confirmDeletePrefix, b.ContainerName)
+	}
+	what := "all blobs"
+	if b.prefix != "" {
+		what = fmt.Sprintf("all blobs with prefix [%s]", b.prefix)
+	}
+	if len(b.Include) > 0 || len(b.Exclude) > 0 || b.OlderThanDays > 0 || b.MinSize > 0 || b.MaxSize > 0 || b.TagQuery != "" {
+		what += " matching the delete filters"
+	}
+	fmt.Printf("This will delete %s from container %s\nType the container name to continue: ", what, b.ContainerName)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("unable to read confirmation: %w", err)
+	}
+	if strings.TrimSpace(answer) != b.ContainerName {
+		return fmt.Errorf("confirmation did not match container %s - nothing deleted", b.ContainerName)
+	}
+	return nil
+}
+
+// deleteFilter selects the blobs a delete removes. It is applied while paging through the container
+type deleteFilter struct {
+	names     *nameFilter
+	olderThan time.Time
+	minSize   int64
+	maxSize   int64
+}
+
+func (b *BlobArchiver) newDeleteFilter() (*deleteFilter, error) {
+	names, err := b.entryFilter()
+	if err != nil {
+		return nil, err
+	}
+	f := &deleteFilter{
+		names:   names,
+		minSize: b.MinSize,
+		maxSize: b.MaxSize,
+	}
+	if b.OlderThanDays > 0 {
+		f.olderThan = time.Now().AddDate(0, 0, -b.OlderThanDays)
+	}
+	return f, nil
+}
+
+// needsProperties reports whether the filter uses blob properties, which a tag query does not return
+func (f *deleteFilter) needsProperties() bool {
+	return !f.olderThan.IsZero() || f.minSize > 0 || f.maxSize > 0
+}
+
+func (f *deleteFilter) Match(blobItem *container.BlobItem) bool {
+	if !f.names.Match(*blobItem.Name) {
+		return false
+	}
+	p := blobItem.Properties
+	if !f.olderThan.IsZero() && (p.LastModified == nil || !p.LastModified.Before(f.olderThan)) {
+		return false
+	}
+	if f.minSize > 0 && (p.ContentLength == nil || *p.ContentLength < f.minSize) {
+		return false
+	}
+	if f.maxSize > 0 && (p.ContentLength == nil || *p.ContentLength > f.maxSize) {
+		return false
+	}
+	return true
+}
+
+// forEachDeleteCandidate pages through the blobs under the prefix, or the blobs matching the blob index tag query,
+// and calls fn for every blob that matches the delete filters. It returns the number of blobs matched
+func (b *BlobArchiver) forEachDeleteCandidate(ctx context.Context, containerClient *container.Client, fn func(*container.BlobItem) error) (int64, error) {
+	filter, err := b.newDeleteFilter()
+	if err != nil {
+		return 0, err
+	}
+	var matched int64
+	match := func(blobItem *container.BlobItem) error {
+		if !filter.Match(blobItem) {
+			return nil
+		}
+		matched++
+		return fn(blobItem)
+	}
+
+	if b.TagQuery == "" {
+		list := match
+		if b.InventoryContainer != "" {
+			// the inventory report and the change feed lag behind the container, so the filters are applied to each
+			// blob as it is now, and the ETag it is deleted with is the one it has now
+			list = func(blobItem *container.BlobItem) error {
+				if !filter.names.Match(*blobItem.Name) {
+					return nil
+				}
+				props, err := containerClient.NewBlobClient(*blobItem.Name).GetProperties(ctx, nil)
+				if bloberror.HasCode(err, bloberror.BlobNotFound) {
+					return nil
+				}
+				if err != nil {
+					return fmt.Errorf("failed to get properties of blob %s: %w", *blobItem.Name, err)
+				}
+				blobItem.Properties.LastModified = props.LastModified
+				blobItem.Properties.ContentLength = props.ContentLength
+				blobItem.Properties.ETag = props.ETag
+				return match(blobItem)
+			}
+		}
+		// pages of up to 5000 blobs are listed under the prefix. The prefix is the top level pathname although it is
+		// not really a path in the filesystem sense. It's more like a tag
+		err := b.forEachBlob(ctx, containerClient, b.prefix, container.ListBlobsInclude{}, list)
+		return matched, err
+	}
+
+	// FindBlobsByTags only returns names and tags, so the properties are fetched when the other filters need them
+	var marker *string
+	for {
+		resp, err := containerClient.FilterBlobs(ctx, b.TagQuery, &container.FilterBlobsOptions{Marker: marker})
+		if err != nil {
+			return matched, fmt.Errorf("failed to find blobs by tags: %w", err)
+		}
+		for _, tagged := range resp.Blobs {
+			if !strings.HasPrefix(*tagged.Name, b.prefix) {
+				continue
+			}
+			blobItem := &container.BlobItem{Name: tagged.Name, Properties: &container.BlobProperties{}}
+			if filter.needsProperties() {
+				props, err := containerClient.NewBlobClient(*tagged.Name).GetProperties(ctx, nil)
+				if err != nil {
+					return matched, fmt.Errorf("failed to get properties of blob %s: %w", *tagged.Name, err)
+				}
+				blobItem.Properties.LastModified = props.LastModified
+				blobItem.Properties.ContentLength = props.ContentLength
+			}
+			if err := match(blobItem); err != nil {
+				return matched, err
+			}
+		}
+		if resp.NextMarker == nil || *resp.NextMarker == "" {
+			return matched, nil
+		}
+		marker = resp.NextMarker
+	}
+}
+
+// dryRunDelete lists and counts the blobs a delete would remove without deleting anything
+func (b *BlobArchiver) dryRunDelete(ctx context.Context, containerClient *container.Client) error {
+	matched, err := b.forEachDeleteCandidate(ctx, containerClient, func(blobItem *container.BlobItem) error {
+		fmt.Println(*blobItem.Name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("dry run: [%d] blobs would be deleted from container %s", matched, b.ContainerName)
 	return nil
 }
 
 // DeleteBatch() **TODO** batch up delete requests and submit in batches
 func (b *BlobArchiver) DeleteBatch() error {
+	// an inventory report can be a day old, so the change feed is needed for the blobs created since. Every blob read
+	// from either is checked against the container before it is deleted, as both lag behind it
+	if b.InventoryContainer != "" && !b.InventoryDelta {
+		return fmt.Errorf("deleting from an inventory report needs --inventory-delta, so blobs created since the report are deleted too")
+	}
+	// a dry run deletes nothing so it needs no confirmation, even for a protected container
+	if b.DryRun {
+		containerClient, err := b.createContainerClient(b.ConnectionString, b.ContainerName)
+		if err != nil {
+			return fmt.Errorf("failed to create container client: %w", err)
+		}
+		return b.dryRunDelete(context.Background(), containerClient)
+	}
+	if err := b.confirmDelete(); err != nil {
+		return err
+	}
 
 	// pager has a limit of 5000 but the batcher limit is 256
 	bar := progressbar.Default(-1, "blobs deleted")
 
 	maxResults := 256
-	maxPagerResults := int32(5000)
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -77,26 +439,14 @@ func (b *BlobArchiver) DeleteBatch() error {
 	batchChan := make(chan *batchProcessor, 25)
 
 	var wg sync.WaitGroup
+	var summary deleteSummary
 	// create a container client
 	containerClient, err := b.createContainerClient(b.ConnectionString, b.ContainerName)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// creates a set of pages (up to 5000 blobs per page) to iterate through. The prefix is the top level pathname
-	// although it is not really a path in the filesystem sense. It's more like a tag
-	pager := containerClient.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
-		Prefix:     &b.prefix,
-		MaxResults: &maxPagerResults,
-	})
-
-	batch, err := containerClient.NewBatchBuilder()
-	if err != nil {
-		return fmt.Errorf("failed to build batch: %w", err)
-	}
-
 	// run through each of the pages
-	// batchChan := make(chan *container.BatchBuilder, 25)
 	for i := 0; i < b.Workers; i++ {
 		wg.Add(1)
 		go func(ctx context.Context, workerNumber int) {
@@ -113,18 +463,7 @@ func (b *BlobArchiver) DeleteBatch() error {
 						// log.Printf("[%d] received nil batch", workerNumber)
 						continue
 					}
-					// log.Printf("[%d] batch received", workerNumber)
-					r, err := containerClient.SubmitBatch(ctx, batcher.batch, nil)
-					if err != nil {
-						log.Printf("failed to submit batch: %v", err)
-					}
-					for n, resp := range r.Responses {
-						if err != nil {
-							log.Printf("[%d][%v] - %v", n, *resp.BlobName, resp.Error)
-						}
-					}
-
-					//log.Printf("[%d] processed batch", workerNumber)
+					deleteWithRetry(ctx, containerClient, batcher.names, batcher.etags, &summary, bar)
 
 				case <-ctx.Done():
 					//log.Printf("[%d] worker cancelled", workerNumber)
@@ -133,34 +472,84 @@ func (b *BlobArchiver) DeleteBatch() error {
 			}
 		}(childCtx, i)
 	}
-	for pager.More() {
-		page, err := pager.NextPage(ctx)
+
+	// with a safety backup, exactly the blobs that were archived are deleted, rather than paging the container again,
+	// and only while they still have the ETag they were archived with
+	forEachCandidate := b.forEachDeleteCandidate
+	var etags map[string]string
+	if !b.SkipSafetyBackup {
+		var candidates []*container.BlobItem
+		if _, err := b.forEachDeleteCandidate(ctx, containerClient, func(blobItem *container.BlobItem) error {
+			candidates = append(candidates, blobItem)
+			return nil
+		}); err != nil {
+			return err
+		}
+		etags, err = b.safetyBackup(candidates, "delete-all-blobs")
 		if err != nil {
-			return fmt.Errorf("failed to list blobs: %w", err)
+			return fmt.Errorf("nothing has been deleted: %w", err)
 		}
-
-		// Send blob names to the batcher as a delete request
-		for k, blobItem := range page.Segment.BlobItems {
-			bar.Add(1)
-			err = batch.Delete(*blobItem.Name, nil)
-			if err != nil {
-				return fmt.Errorf("add delete request to batch: %w", err)
-			}
-			// log.Printf("processing batch item %d", k)
-			// Check if the batch is full.
-			if (k+1)%maxResults == 0 || (k+1) == len(page.Segment.BlobItems) {
-				batchChan <- NewBatchProcessor(batch, k+1)
-				// Reset the batch for the next set of blobs.
-				batch, err = containerClient.NewBatchBuilder()
-				if err != nil {
-					return fmt.Errorf("failed to build batch: %w", err)
+		forEachCandidate = func(_ context.Context, _ *container.Client, fn func(*container.BlobItem) error) (int64, error) {
+			for _, blobItem := range candidates {
+				// a blob deleted before it could be archived is not in the safety backup
+				if etags[*blobItem.Name] == "" {
+					summary.skipped.Add(1)
+					continue
+				}
+				if err := fn(blobItem); err != nil {
+					return 0, err
 				}
 			}
+			return int64(len(candidates)), nil
+		}
+	}
+
+	// blobs read from an inventory report are deleted with the ETag they were checked with, unless the safety backup
+	// already holds the ETag they were archived with
+	var checked map[string]string
+	if etags == nil && b.InventoryContainer != "" {
+		checked = map[string]string{}
+	}
+	send := func(names []string) {
+		if checked == nil {
+			batchChan <- NewBatchProcessor(names, etags)
+			return
 		}
+		batchChan <- NewBatchProcessor(names, checked)
+		checked = map[string]string{}
+	}
+
+	// Send matching blob names to the batcher as delete requests
+	names := make([]string, 0, maxResults)
+	matched, err := forEachCandidate(ctx, containerClient, func(blobItem *container.BlobItem) error {
+		names = append(names, *blobItem.Name)
+		if checked != nil && blobItem.Properties.ETag != nil {
+			checked[*blobItem.Name] = string(*blobItem.Properties.ETag)
+		}
+		// Check if the batch is full.
+		if len(names) == maxResults {
+			send(names)
+			// Reset the batch for the next set of blobs.
+			names = make([]string, 0, maxResults)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		send(names)
 	}
 
 	log.Println("closing batch channel")
 	close(batchChan)
 	wg.Wait()
+
+	failed := summary.failed.Load()
+	log.Printf("[%d] blobs matched, [%d] deleted, [%d] failed, [%d] skipped as already deleted, [%d] skipped as changed since they were checked or archived from container %s",
+		matched, summary.deleted.Load(), failed, summary.skipped.Load(), summary.changed.Load(), b.ContainerName)
+	if failed > 0 {
+		return fmt.Errorf("[%d] blobs could not be deleted", failed)
+	}
 	return nil
 }
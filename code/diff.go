@@ -0,0 +1,240 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// diffEntry is a blob as seen by one side of a diff. ETag and MD5 are empty when the source does not record them
+type diffEntry struct {
+	Size int64
+	ETag string
+	MD5  string
+}
+
+// diffSource is one side of a diff, read into memory keyed by blob name
+type diffSource struct {
+	Spec string
+	// Container is the container the blobs were read from, if it is known. ETags are only comparable between
+	// sources read from the same container
+	Container string
+	Entries   map[string]diffEntry
+}
+
+// diffChange is a blob that differs between the two sides of a diff
+type diffChange struct {
+	Change string `json:"change"`
+	Name   string `json:"name"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Diff compares the blobs in two sources and returns the blobs added, removed and changed going from DiffFrom to
+// DiffTo. A source is container:<name> for a live container, archive:<blob> for an archive in the destination
+// container, tar:<file> for a local tar file or manifest:<file> for the manifest of a backup
+func (b *BlobArchiver) Diff() ([]diffChange, error) {
+	ctx := context.Background()
+	if b.DiffFrom == "" || b.DiffTo == "" {
+		return nil, fmt.Errorf("diff needs both --from and --to")
+	}
+	filter, err := b.entryFilter()
+	if err != nil {
+		return nil, err
+	}
+	from, err := b.loadDiffSource(ctx, b.DiffFrom, filter)
+	if err != nil {
+		return nil, err
+	}
+	to, err := b.loadDiffSource(ctx, b.DiffTo, filter)
+	if err != nil {
+		return nil, err
+	}
+	compareETags := from.Container != "" && from.Container == to.Container
+
+	var changes []diffChange
+	for name, f := range from.Entries {
+		t, ok := to.Entries[name]
+		if !ok {
+			changes = append(changes, diffChange{Change: "removed", Name: name})
+			continue
+		}
+		switch {
+		case f.Size != t.Size:
+			changes = append(changes, diffChange{Change: "changed", Name: name, Reason: fmt.Sprintf("size %d -> %d", f.Size, t.Size)})
+		case f.MD5 != "" && t.MD5 != "" && f.MD5 != t.MD5:
+			changes = append(changes, diffChange{Change: "changed", Name: name, Reason: fmt.Sprintf("md5 %s -> %s", f.MD5, t.MD5)})
+		case compareETags && f.ETag != "" && t.ETag != "" && f.ETag != t.ETag:
+			changes = append(changes, diffChange{Change: "changed", Name: name, Reason: fmt.Sprintf("etag %s -> %s", f.ETag, t.ETag)})
+		}
+	}
+	for name := range to.Entries {
+		if _, ok := from.Entries[name]; !ok {
+			changes = append(changes, diffChange{Change: "added", Name: name})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+
+	log.Printf("[%d] blobs in %s, [%d] blobs in %s, [%d] differences", len(from.Entries), from.Spec, len(to.Entries), to.Spec, len(changes))
+	if !compareETags {
+		log.Printf("ETags are not compared as the sources are not from the same container - changes with the same size are found by MD5 where both sides have one")
+	}
+	return changes, nil
+}
+
+// loadDiffSource reads the blob names, sizes, ETags and MD5s of one side of a diff
+func (b *BlobArchiver) loadDiffSource(ctx context.Context, spec string, filter *nameFilter) (*diffSource, error) {
+	kind, value, ok := strings.Cut(spec, ":")
+	if !ok || value == "" {
+		return nil, fmt.Errorf("invalid diff source [%s] - expected container:<name>, archive:<blob>, tar:<file> or manifest:<file>", spec)
+	}
+	source := &diffSource{Spec: spec, Entries: map[string]diffEntry{}}
+	add := func(name string, entry diffEntry) {
+		if strings.HasPrefix(name, b.prefix) && filter.Match(name) {
+			source.Entries[name] = entry
+		}
+	}
+
+	switch kind {
+	case "container":
+		source.Container = value
+		containerClient, err := b.createContainerClient(b.ConnectionString, value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create container client: %w", err)
+		}
+		// the listing may come from an inventory report, which is read for the container being listed
+		src := *b
+		src.ContainerName = value
+		err = src.forEachBlob(ctx, containerClient, b.prefix, container.ListBlobsInclude{}, func(blobItem *container.BlobItem) error {
+			entry := diffEntry{}
+			p := blobItem.Properties
+			if p.ContentLength != nil {
+				entry.Size = *p.ContentLength
+			}
+			if p.ETag != nil {
+				entry.ETag = string(*p.ETag)
+			}
+			if len(p.ContentMD5) > 0 {
+				entry.MD5 = base64.StdEncoding.EncodeToString(p.ContentMD5)
+			}
+			add(*blobItem.Name, entry)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	case "manifest":
+		manifest, err := readManifest(value)
+		if err != nil {
+			return nil, err
+		}
+		if len(manifest.Entries) == 0 {
+			return nil, fmt.Errorf("manifest %s does not list the archived blobs - it was written before blobs were recorded", value)
+		}
+		source.Container = manifest.SourceContainer
+		for _, e := range manifest.Entries {
+			add(e.Name, diffEntry{Size: e.Size, ETag: e.ETag, MD5: e.MD5})
+		}
+	case "tar":
+		tarReader, closeTarFile, err := openTarFile(value, strings.HasSuffix(value, ".tgz") || b.Compression)
+		if err != nil {
+			return nil, err
+		}
+		defer closeTarFile()
+		if err := readTarDiffEntries(tarReader, add); err != nil {
+			return nil, fmt.Errorf("failed to read tar file %s: %w", value, err)
+		}
+	case "archive":
+		if err := b.loadRemoteArchive(ctx, value, source, add); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown diff source type [%s] - expected container, archive, tar or manifest", kind)
+	}
+	return source, nil
+}
+
+// loadRemoteArchive reads an archive in the destination container. The manifest is used when it lists the archived
+// blobs, otherwise the archive itself is streamed and every entry hashed
+func (b *BlobArchiver) loadRemoteArchive(ctx context.Context, name string, source *diffSource, add func(string, diffEntry)) error {
+	containerClient, err := b.createContainerClient(b.DestinationConnectionString, b.DestinationContainerName)
+	if err != nil {
+		return fmt.Errorf("failed to create container client: %w", err)
+	}
+
+	manifest, err := readRemoteManifest(ctx, containerClient, name)
+	if err != nil {
+		return err
+	}
+	if manifest != nil {
+		source.Container = manifest.SourceContainer
+		if len(manifest.Entries) > 0 {
+			for _, e := range manifest.Entries {
+				add(e.Name, diffEntry{Size: e.Size, ETag: e.ETag, MD5: e.MD5})
+			}
+			return nil
+		}
+	}
+
+	log.Printf("archive %s has no manifest listing its blobs - reading the archive", name)
+	tarReader, closeTarFile, err := openRemoteTarFile(ctx, containerClient, name)
+	if err != nil {
+		return err
+	}
+	defer closeTarFile()
+	if err := readTarDiffEntries(tarReader, add); err != nil {
+		return fmt.Errorf("failed to read archive %s: %w", name, err)
+	}
+	return nil
+}
+
+// readTarDiffEntries reads the size of every file in a tar and hashes its content
+func readTarDiffEntries(tarReader *tar.Reader, add func(string, diffEntry)) error {
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		hash := md5.New()
+		if _, err := io.Copy(hash, tarReader); err != nil {
+			return fmt.Errorf("failed to read %s: %w", header.Name, err)
+		}
+		add(header.Name, diffEntry{Size: header.Size, MD5: base64.StdEncoding.EncodeToString(hash.Sum(nil))})
+	}
+}
+
+// writeDiff prints the changes as text, json or csv. The text format marks added blobs with +, removed with - and
+// changed with ~
+func writeDiff(w io.Writer, changes []diffChange, format string) error {
+	if changes == nil {
+		changes = []diffChange{}
+	}
+	var rows [][]string
+	for _, c := range changes {
+		rows = append(rows, []string{c.Change, c.Name, c.Reason})
+	}
+	marks := map[string]string{"added": "+", "removed": "-", "changed": "~"}
+	return writeRows(w, format, []string{"change", "name", "reason"}, rows, changes, func(tw *tabwriter.Writer) {
+		for _, c := range changes {
+			if c.Reason != "" {
+				fmt.Fprintf(tw, "%s %s (%s)\n", marks[c.Change], c.Name, c.Reason)
+			} else {
+				fmt.Fprintf(tw, "%s %s\n", marks[c.Change], c.Name)
+			}
+		}
+	})
+}
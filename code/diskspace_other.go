@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "fmt"
+
+// freeSpace is not supported on this platform, so old archives are never deleted to make space
+func freeSpace(path string) (uint64, error) {
+	return 0, fmt.Errorf("checking free space is not supported on this platform")
+}
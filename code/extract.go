@@ -0,0 +1,168 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// safeEntryPath turns a tar entry name into a relative path that cannot leave the target directory. Leading slashes
+// are dropped as blob names may start with one, but entries with `..` elements are refused
+func safeEntryPath(name string) (string, error) {
+	rel := strings.TrimLeft(filepath.ToSlash(name), "/")
+	if rel == "" {
+		return "", fmt.Errorf("empty entry name")
+	}
+	for _, element := range strings.Split(rel, "/") {
+		if element == ".." {
+			return "", fmt.Errorf("entry name contains `..`")
+		}
+	}
+	return filepath.FromSlash(rel), nil
+}
+
+// mkdirAllInRoot creates every directory in rel under root. os.Root refuses any path, including symlinks already in
+// the target directory, that would resolve outside of the root
+func mkdirAllInRoot(root *os.Root, rel string) error {
+	dir := ""
+	for _, element := range strings.Split(filepath.ToSlash(rel), "/") {
+		dir = filepath.Join(dir, element)
+		if err := root.Mkdir(dir, 0755); err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// errUnsafeEntry is returned for a tar entry whose name would leave the target directory
+var errUnsafeEntry = errors.New("unsafe entry name")
+
+// createEntryFile creates the file a tar entry is extracted to under root, and the directories above it. It returns the
+// file and its path relative to root. A name that would leave root is refused with errUnsafeEntry, and an existing
+// file gives fs.ErrExist unless overwrite is set. Every extract goes through here so the checks are in one place
+func createEntryFile(root *os.Root, header *tar.Header, overwrite bool) (*os.File, string, error) {
+	rel, err := safeEntryPath(header.Name)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %w", errUnsafeEntry, err)
+	}
+	if dir := filepath.Dir(rel); dir != "." {
+		if err := mkdirAllInRoot(root, dir); err != nil {
+			return nil, "", err
+		}
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if !overwrite {
+		flags |= os.O_EXCL
+	}
+	f, err := root.OpenFile(rel, flags, header.FileInfo().Mode().Perm())
+	if err != nil {
+		return nil, "", err
+	}
+	return f, rel, nil
+}
+
+// ExtractTarFile writes the entries of a tar file, or with RemoteTarFile an archive in the destination container, to a
+// local directory, restoring their modification times. When only some entries are included and the archive has an
+// index, each included entry is read straight from where it starts
+func (b *BlobArchiver) ExtractTarFile() error {
+	ctx := context.Background()
+	target := b.destinationPath
+	if target == "" {
+		return fmt.Errorf("a target directory (-dp or --destination-path) is required to extract to")
+	}
+	filter, err := b.entryFilter()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	root, err := os.OpenRoot(target)
+	if err != nil {
+		return fmt.Errorf("unable to open target directory %s: %w", target, err)
+	}
+	defer root.Close()
+
+	log.Printf("extracting tarfile [%s] to [%s]", b.archiveName(), target)
+	bar := progressbar.DefaultBytes(-1, "extracting tarfile")
+	var extracted, existing, refused, failed int
+	extract := func(header *tar.Header, r io.Reader) error {
+		f, _, err := createEntryFile(root, header, b.Overwrite)
+		if errors.Is(err, errUnsafeEntry) {
+			log.Printf("refusing to extract [%s]: %v", header.Name, err)
+			refused++
+			return nil
+		}
+		if errors.Is(err, fs.ErrExist) {
+			existing++
+			return nil
+		}
+		if err != nil {
+			log.Printf("failed to extract [%s]: %v", header.Name, err)
+			failed++
+			return nil
+		}
+		_, err = io.Copy(io.MultiWriter(f, bar), r)
+		if err == nil {
+			if err := setModTime(f, header.ModTime); err != nil {
+				log.Printf("unable to set modification time of [%s]: %v", header.Name, err)
+			}
+		}
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to extract [%s]: %w", header.Name, err)
+		}
+		extracted++
+		return nil
+	}
+
+	var index *archiveIndex
+	if len(b.Include) > 0 {
+		if index, err = b.archiveIndexIfAny(ctx); err != nil {
+			return err
+		}
+	}
+	if index != nil {
+		log.Printf("reading the included entries using the index of %s", b.archiveName())
+		if err := b.readIndexedEntries(ctx, index, filter.Match, extract); err != nil {
+			return err
+		}
+	} else {
+		tarReader, closeTarFile, err := b.openArchive(ctx)
+		if err != nil {
+			return err
+		}
+		defer closeTarFile()
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read tar file: %w", err)
+			}
+			if header.Typeflag != tar.TypeReg || !filter.Match(header.Name) {
+				continue
+			}
+			if err := extract(header, tarReader); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Printf("[%d] entries extracted to %s, [%d] already existed (use -o to overwrite), [%d] refused, [%d] failed",
+		extracted, target, existing, refused, failed)
+	if refused > 0 || failed > 0 {
+		return fmt.Errorf("[%d] entries could not be extracted", refused+failed)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSafeEntryPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "a.txt", want: "a.txt"},
+		{name: "dir/sub/a.txt", want: filepath.Join("dir", "sub", "a.txt")},
+		{name: "/abs/a.txt", want: filepath.Join("abs", "a.txt")},
+		{name: "//a.txt", want: "a.txt"},
+		{name: "dir/..file", want: filepath.Join("dir", "..file")},
+		{name: "", wantErr: true},
+		{name: "/", wantErr: true},
+		{name: "..", wantErr: true},
+		{name: "../a.txt", wantErr: true},
+		{name: "dir/../../a.txt", wantErr: true},
+		{name: "/../a.txt", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := safeEntryPath(tt.name)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("safeEntryPath(%q) = %q, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("safeEntryPath(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// setModTime is not supported on this platform, as the time can only be set by path, which could be swapped for a link
+// after the file was created
+func setModTime(f *os.File, t time.Time) error {
+	return fmt.Errorf("setting the modification time of an open file is not supported on this platform")
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// setModTime sets the access and modification time of an open file through its handle, so the path is not resolved
+// again after the file was created
+func setModTime(f *os.File, t time.Time) error {
+	tv := syscall.NsecToTimeval(t.UnixNano())
+	return syscall.Futimes(int(f.Fd()), []syscall.Timeval{tv, tv})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// globToRegexp converts a glob to a regular expression. `*` and `?` do not match `/`, `**` matches anything
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				re.WriteString(".*")
+				i++
+			} else {
+				re.WriteString("[^/]*")
+			}
+		case '?':
+			re.WriteString("[^/]")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
+
+// nameFilter selects blob or tar entry names by include and exclude globs. A name is selected if it matches any
+// include glob (or there are none) and does not match any exclude glob
+type nameFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+func newNameFilter(include, exclude []string) (*nameFilter, error) {
+	f := new(nameFilter)
+	for _, glob := range include {
+		re, err := globToRegexp(glob)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include pattern [%s]: %w", glob, err)
+		}
+		f.include = append(f.include, re)
+	}
+	for _, glob := range exclude {
+		re, err := globToRegexp(glob)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern [%s]: %w", glob, err)
+		}
+		f.exclude = append(f.exclude, re)
+	}
+	return f, nil
+}
+
+func (f *nameFilter) Match(name string) bool {
+	for _, re := range f.exclude {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, re := range f.include {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// entryFilter builds the filter from the include and exclude flags
+func (b *BlobArchiver) entryFilter() (*nameFilter, error) {
+	return newNameFilter(b.Include, b.Exclude)
+}
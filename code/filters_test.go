@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob  string
+		name  string
+		match bool
+	}{
+		{"*.txt", "a.txt", true},
+		{"*.txt", "dir/a.txt", false},
+		{"**.txt", "dir/a.txt", true},
+		{"dir/**", "dir/sub/a.txt", true},
+		{"dir/*", "dir/sub/a.txt", false},
+		{"file?.log", "file1.log", true},
+		{"file?.log", "file10.log", false},
+		{"file?.log", "file/.log", false},
+		{"a.b", "axb", false},
+		{"(a)+[b]", "(a)+[b]", true},
+	}
+	for _, tt := range tests {
+		re, err := globToRegexp(tt.glob)
+		if err != nil {
+			t.Fatalf("globToRegexp(%q): %v", tt.glob, err)
+		}
+		if got := re.MatchString(tt.name); got != tt.match {
+			t.Errorf("globToRegexp(%q) matching %q = %v, want %v", tt.glob, tt.name, got, tt.match)
+		}
+	}
+}
+
+func TestNameFilterMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		entry   string
+		match   bool
+	}{
+		{"no globs selects everything", nil, nil, "any/name", true},
+		{"include matches", []string{"logs/**"}, nil, "logs/2025/a.log", true},
+		{"include does not match", []string{"logs/**"}, nil, "data/a.csv", false},
+		{"any include matches", []string{"logs/**", "*.csv"}, nil, "a.csv", true},
+		{"exclude only", nil, []string{"**.tmp"}, "dir/a.tmp", false},
+		{"exclude wins over include", []string{"logs/**"}, []string{"**.tmp"}, "logs/a.tmp", false},
+		{"exclude does not match", []string{"logs/**"}, []string{"**.tmp"}, "logs/a.log", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newNameFilter(tt.include, tt.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.Match(tt.entry); got != tt.match {
+				t.Errorf("Match(%q) = %v, want %v", tt.entry, got, tt.match)
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// indexSuffix is appended to the tar file name for the index written alongside every backup
+const indexSuffix = ".index.json"
+
+// a compressed archive starts a new gzip member at the first entry after this many uncompressed bytes. Every member
+// can be decompressed on its own, so an entry can be read starting from the member it is in. A var so tests can use
+// small members
+var indexFrameSize int64 = 64 * 1024 * 1024
+
+// archiveIndex records where every entry of a tar file starts, so single entries can be read without reading the
+// archive up to them
+type archiveIndex struct {
+	Compressed bool         `json:"compressed"`
+	Entries    []indexEntry `json:"entries"`
+}
+
+// indexEntry locates one entry. Offset is where its tar header starts in the uncompressed tar. For a compressed archive,
+// Frame is where the gzip member holding the header starts in the file and FrameOffset is the uncompressed offset of
+// that member. Length is the number of bytes from Frame, or Offset when uncompressed, that hold the whole entry - 0
+// means to the end of the file
+type indexEntry struct {
+	Name        string `json:"name"`
+	Offset      int64  `json:"offset"`
+	Size        int64  `json:"size"`
+	Frame       int64  `json:"frame,omitempty"`
+	FrameOffset int64  `json:"frameOffset,omitempty"`
+	Length      int64  `json:"length,omitempty"`
+	end         int64
+}
+
+func indexFile(tarFile string) string {
+	return tarFile + indexSuffix
+}
+
+func readIndex(file string) (*archiveIndex, error) {
+	f, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open index : %w", err)
+	}
+	index := new(archiveIndex)
+	if err := json.Unmarshal(f, index); err != nil {
+		return nil, fmt.Errorf("unable to read index %s : %w", file, err)
+	}
+	return index, nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// archiveWriter writes the tar file for a backup along with its manifest entries and index. It is safe to add entries
+// from several goroutines
+type archiveWriter struct {
+	mutex sync.Mutex
+	file  *countingWriter
+	gzip  *gzip.Writer
+	// tarStream counts the uncompressed bytes of the tar
+	tarStream *countingWriter
+	tar       *tar.Writer
+
+	frame       int64
+	frameOffset int64
+	// the compressed and uncompressed offsets of every gzip member
+	frames [][2]int64
+
+	entries []manifestEntry
+	index   []indexEntry
+}
+
+// frameStream writes to the current gzip member, which changes as new members are started
+type frameStream struct {
+	a *archiveWriter
+}
+
+func (f frameStream) Write(p []byte) (int, error) {
+	return f.a.gzip.Write(p)
+}
+
+func newArchiveWriter(w io.Writer, compressed bool) (*archiveWriter, error) {
+	a := &archiveWriter{file: &countingWriter{w: w}}
+	if !compressed {
+		a.tarStream = &countingWriter{w: a.file}
+	} else {
+		// maximise compression. I might make this switchable later on but, at the moment, that just feels like Yak shaving
+		gzipWriter, err := gzip.NewWriterLevel(a.file, 9)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gzip writer : %v", err)
+		}
+		a.gzip = gzipWriter
+		a.tarStream = &countingWriter{w: frameStream{a}}
+		a.frames = append(a.frames, [2]int64{0, 0})
+	}
+	a.tar = tar.NewWriter(a.tarStream)
+	return a, nil
+}
+
+// add writes an entry to the tar, recording where it starts and the MD5 of its content
+func (a *archiveWriter) add(header *tar.Header, r io.Reader, etag *string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// write the padding of the previous entry so the header starts at the current offset
+	if err := a.tar.Flush(); err != nil {
+		return fmt.Errorf("failed to write tar file: %w", err)
+	}
+	if a.gzip != nil && a.tarStream.n-a.frameOffset >= indexFrameSize {
+		if err := a.gzip.Close(); err != nil {
+			return fmt.Errorf("failed to write tar file: %w", err)
+		}
+		a.gzip.Reset(a.file)
+		a.frame, a.frameOffset = a.file.n, a.tarStream.n
+		a.frames = append(a.frames, [2]int64{a.frame, a.frameOffset})
+	}
+
+	location := indexEntry{Name: header.Name, Offset: a.tarStream.n, Size: header.Size, Frame: a.frame, FrameOffset: a.frameOffset}
+	if err := a.tar.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write tar header for %s: %w", header.Name, err)
+	}
+	hash := md5.New()
+	if _, err := io.Copy(io.MultiWriter(a.tar, hash), r); err != nil {
+		return fmt.Errorf("failed to write blob %s to tar: %w", header.Name, err)
+	}
+	location.end = a.tarStream.n
+
+	entry := manifestEntry{
+		Name:    header.Name,
+		Size:    header.Size,
+		ModTime: header.ModTime.UTC(),
+		MD5:     base64.StdEncoding.EncodeToString(hash.Sum(nil)),
+	}
+	if etag != nil {
+		entry.ETag = *etag
+	}
+	a.entries = append(a.entries, entry)
+	a.index = append(a.index, location)
+	return nil
+}
+
+// Close finishes the tar file and works out how many bytes of it hold each entry
+func (a *archiveWriter) Close() error {
+	if err := a.tar.Close(); err != nil {
+		return fmt.Errorf("failed to finish tar file: %w", err)
+	}
+	if a.gzip != nil {
+		if err := a.gzip.Close(); err != nil {
+			return fmt.Errorf("failed to finish tar file: %w", err)
+		}
+	}
+	for i, e := range a.index {
+		if a.gzip == nil {
+			a.index[i].Length = e.end - e.Offset
+			continue
+		}
+		// the entry ends in the member before the first member starting after it
+		next := sort.Search(len(a.frames), func(j int) bool { return a.frames[j][1] >= e.end })
+		if next < len(a.frames) {
+			a.index[i].Length = a.frames[next][0] - e.Frame
+		}
+	}
+	return nil
+}
+
+// writeIndex writes the index next to the tar file
+func (a *archiveWriter) writeIndex(file string) error {
+	f, err := json.Marshal(&archiveIndex{Compressed: a.gzip != nil, Entries: a.index})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, f, 0600)
+}
+
+// archiveIndexIfAny reads the index of the tar file or, with RemoteTarFile, the archive blob. It returns nil if there
+// is none, as archives taken before indexes were written do not have one
+func (b *BlobArchiver) archiveIndexIfAny(ctx context.Context) (*archiveIndex, error) {
+	if !b.RemoteTarFile {
+		index, err := readIndex(indexFile(b.TarFile()))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return index, err
+	}
+	containerClient, err := b.createContainerClient(b.DestinationConnectionString, b.DestinationContainerName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container client: %w", err)
+	}
+	resp, err := containerClient.NewBlobClient(indexFile(b.TarFileName)).DownloadStream(ctx, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to download index of %s: %w", b.TarFileName, err)
+	}
+	defer resp.Body.Close()
+	index := new(archiveIndex)
+	if err := json.NewDecoder(resp.Body).Decode(index); err != nil {
+		return nil, fmt.Errorf("unable to read index of %s: %w", b.TarFileName, err)
+	}
+	return index, nil
+}
+
+// readIndexedEntries calls fn with every entry of the index that match accepts, reading each one straight from where
+// it starts. A local tar file is read with a seek, an archive blob with a ranged GET
+func (b *BlobArchiver) readIndexedEntries(ctx context.Context, index *archiveIndex, match func(string) bool, fn func(*tar.Header, io.Reader) error) error {
+	var containerClient *container.Client
+	var localFile *os.File
+	var err error
+	if b.RemoteTarFile {
+		if containerClient, err = b.createContainerClient(b.DestinationConnectionString, b.DestinationContainerName); err != nil {
+			return fmt.Errorf("failed to create container client: %w", err)
+		}
+	} else {
+		if localFile, err = os.Open(b.TarFile()); err != nil {
+			return fmt.Errorf("failed to open tar file: %w", err)
+		}
+		defer localFile.Close()
+	}
+
+	for _, e := range index.Entries {
+		if !match(e.Name) {
+			continue
+		}
+		start := e.Offset
+		if index.Compressed {
+			start = e.Frame
+		}
+
+		var raw io.ReadCloser
+		if containerClient != nil {
+			resp, err := containerClient.NewBlobClient(b.TarFileName).DownloadStream(ctx, &blob.DownloadStreamOptions{
+				Range: blob.HTTPRange{Offset: start, Count: e.Length},
+			})
+			if err != nil {
+				return fmt.Errorf("unable to download [%s] from %s: %w", e.Name, b.TarFileName, err)
+			}
+			raw = resp.Body
+		} else {
+			if _, err := localFile.Seek(start, io.SeekStart); err != nil {
+				return fmt.Errorf("unable to seek to [%s]: %w", e.Name, err)
+			}
+			raw = io.NopCloser(localFile)
+			if e.Length > 0 {
+				raw = io.NopCloser(io.LimitReader(localFile, e.Length))
+			}
+		}
+
+		err := func() error {
+			defer raw.Close()
+			var stream io.Reader = raw
+			if index.Compressed {
+				gzipReader, err := gzip.NewReader(raw)
+				if err != nil {
+					return fmt.Errorf("unable to read [%s]: %w", e.Name, err)
+				}
+				defer gzipReader.Close()
+				// skip the entries before this one in the same member
+				if _, err := io.CopyN(io.Discard, gzipReader, e.Offset-e.FrameOffset); err != nil {
+					return fmt.Errorf("unable to read [%s]: %w", e.Name, err)
+				}
+				stream = gzipReader
+			}
+			tarReader := tar.NewReader(stream)
+			header, err := tarReader.Next()
+			if err != nil {
+				return fmt.Errorf("unable to read [%s]: %w", e.Name, err)
+			}
+			if header.Name != e.Name {
+				return fmt.Errorf("index does not match the archive - found [%s] where [%s] should be", header.Name, e.Name)
+			}
+			return fn(header, tarReader)
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
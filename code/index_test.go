@@ -0,0 +1,94 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchiveWriterIndexRoundTrip(t *testing.T) {
+	defer func(size int64) { indexFrameSize = size }(indexFrameSize)
+	indexFrameSize = 4096
+
+	contents := map[string][]byte{}
+	var names []string
+	for i := range 20 {
+		name := fmt.Sprintf("dir/blob-%02d", i)
+		// sizes either side of the frame size, so entries both share members and span them
+		contents[name] = bytes.Repeat([]byte{byte('a' + i)}, i*517)
+		names = append(names, name)
+	}
+
+	for _, compressed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compressed=%v", compressed), func(t *testing.T) {
+			dir := t.TempDir()
+			b := &BlobArchiver{Path: dir, TarFileName: "archive.tar", Compression: compressed}
+			f, err := os.Create(b.TarFile())
+			if err != nil {
+				t.Fatal(err)
+			}
+			a, err := newArchiveWriter(f, compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range names {
+				header := &tar.Header{Name: name, Size: int64(len(contents[name])), Mode: 0600, ModTime: time.Now()}
+				if err := a.add(header, bytes.NewReader(contents[name]), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := a.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if compressed && len(a.frames) < 2 {
+				t.Fatalf("expected several gzip members, got %d", len(a.frames))
+			}
+			if err := a.writeIndex(indexFile(b.TarFile())); err != nil {
+				t.Fatal(err)
+			}
+			index, err := readIndex(filepath.Join(dir, "archive.tar"+indexSuffix))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if index.Compressed != compressed || len(index.Entries) != len(names) {
+				t.Fatalf("index has compressed %v and %d entries, want %v and %d", index.Compressed, len(index.Entries), compressed, len(names))
+			}
+
+			// read every other entry so each is found from its own offsets rather than by reading on
+			want := map[string]bool{}
+			for i, name := range names {
+				if i%2 == 1 {
+					want[name] = true
+				}
+			}
+			got := map[string]bool{}
+			err = b.readIndexedEntries(context.Background(), index, func(name string) bool { return want[name] },
+				func(header *tar.Header, r io.Reader) error {
+					data, err := io.ReadAll(r)
+					if err != nil {
+						return err
+					}
+					if !bytes.Equal(data, contents[header.Name]) {
+						return fmt.Errorf("[%s] read %d bytes that do not match the %d written", header.Name, len(data), len(contents[header.Name]))
+					}
+					got[header.Name] = true
+					return nil
+				})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(want) {
+				t.Errorf("read %d entries, want %d", len(got), len(want))
+			}
+		})
+	}
+}
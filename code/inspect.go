@@ -0,0 +1,213 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// archiveEntry is an entry of an archive as listed by inspect
+type archiveEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// archiveName is the tar file, or the archive blob with RemoteTarFile, for messages
+func (b *BlobArchiver) archiveName() string {
+	if b.RemoteTarFile {
+		return b.TarFileName
+	}
+	return b.TarFile()
+}
+
+// openArchive opens the tar file, or with RemoteTarFile the archive blob of that name in the destination container
+func (b *BlobArchiver) openArchive(ctx context.Context) (*tar.Reader, func() error, error) {
+	if !b.RemoteTarFile {
+		return openTarFile(b.TarFile(), b.Compression || strings.HasSuffix(b.TarFile(), ".tgz"))
+	}
+	containerClient, err := b.createContainerClient(b.DestinationConnectionString, b.DestinationContainerName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create container client: %w", err)
+	}
+	return openRemoteTarFile(ctx, containerClient, b.TarFileName)
+}
+
+// archiveManifestIfAny reads the manifest of the tar file or archive blob. It returns nil if there is none
+func (b *BlobArchiver) archiveManifestIfAny(ctx context.Context) (*archiveManifest, error) {
+	if !b.RemoteTarFile {
+		manifest, err := readManifest(manifestFile(b.TarFile()))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return manifest, err
+	}
+	containerClient, err := b.createContainerClient(b.DestinationConnectionString, b.DestinationContainerName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container client: %w", err)
+	}
+	return readRemoteManifest(ctx, containerClient, b.TarFileName)
+}
+
+// InspectArchive lists the entries of a local tar file, or an archive in the destination container, that match the
+// include and exclude globs. The manifest is used when it lists the archived blobs, otherwise the tar headers are read
+func (b *BlobArchiver) InspectArchive() ([]archiveEntry, error) {
+	ctx := context.Background()
+	filter, err := b.entryFilter()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []archiveEntry
+	manifest, err := b.archiveManifestIfAny(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if manifest != nil && len(manifest.Entries) > 0 {
+		log.Printf("listing entries from the manifest of %s", b.archiveName())
+		for _, e := range manifest.Entries {
+			if filter.Match(e.Name) {
+				entries = append(entries, archiveEntry{Name: e.Name, Size: e.Size, ModTime: e.ModTime})
+			}
+		}
+		return entries, nil
+	}
+
+	log.Printf("%s has no manifest listing its entries - reading the tar headers", b.archiveName())
+	tarReader, closeTarFile, err := b.openArchive(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer closeTarFile()
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar file: %w", err)
+		}
+		if header.Typeflag == tar.TypeReg && filter.Match(header.Name) {
+			entries = append(entries, archiveEntry{Name: header.Name, Size: header.Size, ModTime: header.ModTime})
+		}
+	}
+}
+
+// errEntryNotFound is returned when an archive does not have the entry asked for
+var errEntryNotFound = errors.New("entry not found")
+
+// InspectEntry writes the content of a single entry to w, or when a destination path is set extracts it under that
+// directory
+func (b *BlobArchiver) InspectEntry(w io.Writer) error {
+	ctx := context.Background()
+	index, err := b.archiveIndexIfAny(ctx)
+	if err != nil {
+		return err
+	}
+	return b.readEntry(ctx, index, b.Entry, func(header *tar.Header, r io.Reader) error {
+		if b.destinationPath == "" {
+			_, err := io.Copy(w, r)
+			return err
+		}
+		return b.extractEntry(header, r)
+	})
+}
+
+// readEntry calls fn with the named entry of the archive. With an index the entry is read straight from where it
+// starts, otherwise the archive is read up to it
+func (b *BlobArchiver) readEntry(ctx context.Context, index *archiveIndex, name string, fn func(*tar.Header, io.Reader) error) error {
+	if index != nil {
+		var found bool
+		err := b.readIndexedEntries(ctx, index, func(e string) bool { return e == name }, func(header *tar.Header, r io.Reader) error {
+			found = true
+			return fn(header, r)
+		})
+		if err == nil && !found {
+			return fmt.Errorf("[%s] is not in the index of %s: %w", name, b.archiveName(), errEntryNotFound)
+		}
+		return err
+	}
+
+	tarReader, closeTarFile, err := b.openArchive(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeTarFile()
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return fmt.Errorf("[%s] is not in %s: %w", name, b.archiveName(), errEntryNotFound)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar file: %w", err)
+		}
+		if header.Name != name || header.Typeflag != tar.TypeReg {
+			continue
+		}
+		return fn(header, tarReader)
+	}
+}
+
+// extractEntry writes a single tar entry under the destination path, using the same checks as extract
+func (b *BlobArchiver) extractEntry(header *tar.Header, r io.Reader) error {
+	if err := os.MkdirAll(b.destinationPath, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	root, err := os.OpenRoot(b.destinationPath)
+	if err != nil {
+		return fmt.Errorf("unable to open target directory %s: %w", b.destinationPath, err)
+	}
+	defer root.Close()
+	f, rel, err := createEntryFile(root, header, b.Overwrite)
+	if errors.Is(err, errUnsafeEntry) {
+		return fmt.Errorf("refusing to extract [%s]: %w", header.Name, err)
+	}
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("[%s] already exists in %s - use -o to overwrite", header.Name, b.destinationPath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to extract [%s]: %w", header.Name, err)
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		if err := setModTime(f, header.ModTime); err != nil {
+			log.Printf("unable to set modification time of [%s]: %v", header.Name, err)
+		}
+	}
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to extract [%s]: %w", header.Name, err)
+	}
+	log.Printf("[%s] extracted to %s", header.Name, filepath.Join(b.destinationPath, rel))
+	return nil
+}
+
+// writeArchiveEntries prints the entries as a table, json or csv
+func writeArchiveEntries(w io.Writer, entries []archiveEntry, format string) error {
+	if entries == nil {
+		entries = []archiveEntry{}
+	}
+	var rows [][]string
+	for _, e := range entries {
+		rows = append(rows, []string{e.Name, strconv.FormatInt(e.Size, 10), e.ModTime.Format(time.RFC3339)})
+	}
+	return writeRows(w, format, []string{"name", "size", "modTime"}, rows, entries, func(tw *tabwriter.Writer) {
+		fmt.Fprintln(tw, "SIZE\tMODIFIED\tNAME")
+		var total int64
+		for _, e := range entries {
+			total += e.Size
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", ByteCountSI(e.Size), e.ModTime.Format(time.RFC3339), e.Name)
+		}
+		fmt.Fprintf(tw, "%s\t\t[%d] entries\n", ByteCountSI(total), len(entries))
+	})
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/deprecated"
+)
+
+// inventoryManifestSuffix ends the name of the manifest Azure writes next to every blob inventory report
+const inventoryManifestSuffix = "-manifest.json"
+
+// inventoryManifest is the part of a blob inventory manifest that is needed to read the report
+type inventoryManifest struct {
+	RuleName           string    `json:"ruleName"`
+	Status             string    `json:"status"`
+	InventoryStartTime time.Time `json:"inventoryStartTime"`
+	Files              []struct {
+		Blob string `json:"blob"`
+	} `json:"files"`
+	RuleDefinition struct {
+		Format     string `json:"format"`
+		ObjectType string `json:"objectType"`
+	} `json:"ruleDefinition"`
+}
+
+// newestInventoryReport finds the newest successful blob inventory report in the inventory container. Reports are
+// written under YYYY/MM/DD/HH-MM-SS/<rule>/, so the newest manifest has the largest name
+func (b *BlobArchiver) newestInventoryReport(ctx context.Context, inventoryClient *container.Client) (*inventoryManifest, error) {
+	suffix := inventoryManifestSuffix
+	if b.InventoryRule != "" {
+		suffix = "/" + b.InventoryRule + "/" + b.InventoryRule + inventoryManifestSuffix
+	}
+	var manifests []string
+	pager := inventoryClient.NewListBlobsFlatPager(nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list inventory container %s: %w", b.InventoryContainer, err)
+		}
+		for _, blobItem := range page.Segment.BlobItems {
+			if strings.HasSuffix(*blobItem.Name, suffix) {
+				manifests = append(manifests, *blobItem.Name)
+			}
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(manifests)))
+
+	for _, name := range manifests {
+		resp, err := inventoryClient.NewBlobClient(name).DownloadStream(ctx, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to download inventory manifest %s: %w", name, err)
+		}
+		manifest := &inventoryManifest{}
+		err = json.NewDecoder(resp.Body).Decode(manifest)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read inventory manifest %s: %w", name, err)
+		}
+		if manifest.Status != "Succeeded" {
+			log.Printf("skipping inventory report %s with status %s", name, manifest.Status)
+			continue
+		}
+		if format := manifest.RuleDefinition.Format; !strings.EqualFold(format, "csv") && !strings.EqualFold(format, "parquet") {
+			return nil, fmt.Errorf("inventory report %s is %s - only CSV and Parquet reports can be read", name, format)
+		}
+		if manifest.RuleDefinition.ObjectType != "" && !strings.EqualFold(manifest.RuleDefinition.ObjectType, "blob") {
+			return nil, fmt.Errorf("inventory report %s lists %s objects, not blobs", name, manifest.RuleDefinition.ObjectType)
+		}
+		log.Printf("using inventory report %s started at %s", name, manifest.InventoryStartTime.Format(time.RFC3339))
+		return manifest, nil
+	}
+	return nil, fmt.Errorf("no successful inventory report found in container %s", b.InventoryContainer)
+}
+
+// parseInventoryTime reads the time columns of an inventory report, which may be RFC3339 or the HTTP date format
+func parseInventoryTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(http.TimeFormat, s)
+}
+
+// inventoryBlobItem builds the blob item for a row of an inventory report from its columns, which are read with value.
+// ok is false for a row that is not a current blob of the container under prefix. The Name column holds
+// <container>/<blob>
+func inventoryBlobItem(value func(column string) string, containerName, prefix string) (blobItem *container.BlobItem, ok bool, err error) {
+	name, ok := strings.CutPrefix(value("Name"), containerName+"/")
+	if !ok || !strings.HasPrefix(name, prefix) {
+		return nil, false, nil
+	}
+	// only the current version of a live blob is listed, the same as a flat listing
+	if value("Snapshot") != "" || value("Deleted") == "true" || value("IsCurrentVersion") == "false" {
+		return nil, false, nil
+	}
+
+	blobItem = &container.BlobItem{Name: &name, Properties: &container.BlobProperties{}}
+	p := blobItem.Properties
+	if v := value("Content-Length"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid Content-Length for %s: %w", name, err)
+		}
+		p.ContentLength = &size
+	}
+	if v := value("Last-Modified"); v != "" {
+		if t, err := parseInventoryTime(v); err == nil {
+			p.LastModified = &t
+		}
+	}
+	if v := value("Creation-Time"); v != "" {
+		if t, err := parseInventoryTime(v); err == nil {
+			p.CreationTime = &t
+		}
+	}
+	if v := value("Content-Type"); v != "" {
+		contentType := v
+		p.ContentType = &contentType
+	}
+	if v := value("Content-MD5"); v != "" {
+		if md5, err := base64.StdEncoding.DecodeString(v); err == nil {
+			p.ContentMD5 = md5
+		}
+	}
+	if v := value("BlobType"); v != "" {
+		blobType := blob.BlobType(v)
+		p.BlobType = &blobType
+	}
+	if v := value("AccessTier"); v != "" {
+		tier := blob.AccessTier(v)
+		p.AccessTier = &tier
+	}
+	return blobItem, true, nil
+}
+
+// readInventoryFile calls fn for every current blob in one CSV file of an inventory report that belongs to the
+// container and starts with prefix
+func readInventoryFile(r io.Reader, containerName, prefix string, fn func(*container.BlobItem) error) error {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("unable to read header: %w", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[name] = i
+	}
+	if _, ok := columns["Name"]; !ok {
+		return fmt.Errorf("inventory report has no Name column")
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		value := func(column string) string {
+			if i, ok := columns[column]; ok && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		blobItem, ok, err := inventoryBlobItem(value, containerName, prefix)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := fn(blobItem); err != nil {
+			return err
+		}
+	}
+}
+
+// parquetValueString converts a value of a Parquet inventory report to the text the CSV report holds for it.
+// Timestamps become RFC3339 and binary values that are not UTF-8 strings, such as Content-MD5, become base64
+func parquetValueString(v parquet.Value, t parquet.Type) string {
+	if v.IsNull() {
+		return ""
+	}
+	lt, ct := t.LogicalType(), t.ConvertedType()
+	var unit func(int64) time.Time
+	switch {
+	case lt != nil && lt.Timestamp != nil && lt.Timestamp.Unit.Millis != nil, ct != nil && *ct == deprecated.TimestampMillis:
+		unit = time.UnixMilli
+	case lt != nil && lt.Timestamp != nil && lt.Timestamp.Unit.Micros != nil, ct != nil && *ct == deprecated.TimestampMicros:
+		unit = time.UnixMicro
+	case lt != nil && lt.Timestamp != nil && lt.Timestamp.Unit.Nanos != nil:
+		unit = func(n int64) time.Time { return time.Unix(0, n) }
+	}
+	if unit != nil {
+		return unit(v.Int64()).UTC().Format(time.RFC3339Nano)
+	}
+	switch v.Kind() {
+	case parquet.Boolean:
+		return strconv.FormatBool(v.Boolean())
+	case parquet.Int32:
+		return strconv.FormatInt(int64(v.Int32()), 10)
+	case parquet.Int64:
+		return strconv.FormatInt(v.Int64(), 10)
+	case parquet.ByteArray, parquet.FixedLenByteArray:
+		if (lt != nil && lt.UTF8 != nil) || (ct != nil && *ct == deprecated.UTF8) {
+			return string(v.ByteArray())
+		}
+		return base64.StdEncoding.EncodeToString(v.ByteArray())
+	}
+	return v.String()
+}
+
+// readParquetInventoryFile calls fn for every current blob in one Parquet file of an inventory report that belongs to
+// the container and starts with prefix. Only the top level columns are read, nested ones such as tags are ignored
+func readParquetInventoryFile(r io.ReaderAt, size int64, containerName, prefix string, fn func(*container.BlobItem) error) error {
+	f, err := parquet.OpenFile(r, size)
+	if err != nil {
+		return fmt.Errorf("unable to open Parquet file: %w", err)
+	}
+	schema := f.Schema()
+	columns := map[string]int{}
+	types := map[int]parquet.Type{}
+	for _, path := range schema.Columns() {
+		if len(path) != 1 {
+			continue
+		}
+		leaf, _ := schema.Lookup(path...)
+		columns[path[0]] = leaf.ColumnIndex
+		types[leaf.ColumnIndex] = leaf.Node.Type()
+	}
+	if _, ok := columns["Name"]; !ok {
+		return fmt.Errorf("inventory report has no Name column")
+	}
+
+	reader := parquet.NewReader(f)
+	defer reader.Close()
+	rows := make([]parquet.Row, 1024)
+	record := map[int]parquet.Value{}
+	value := func(column string) string {
+		i, ok := columns[column]
+		if !ok {
+			return ""
+		}
+		v, ok := record[i]
+		if !ok {
+			return ""
+		}
+		return parquetValueString(v, types[i])
+	}
+	for {
+		n, err := reader.ReadRows(rows)
+		for _, row := range rows[:n] {
+			clear(record)
+			for _, v := range row {
+				if _, ok := types[v.Column()]; ok {
+					record[v.Column()] = v
+				}
+			}
+			blobItem, ok, err := inventoryBlobItem(value, containerName, prefix)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if err := fn(blobItem); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readInventoryBlob reads one file of an inventory report. Parquet files are read from the end, so they are
+// downloaded to a temporary file first, while CSV files are streamed
+func (b *BlobArchiver) readInventoryBlob(ctx context.Context, inventoryClient *container.Client, name, prefix string, fn func(*container.BlobItem) error) error {
+	if !strings.HasSuffix(name, ".parquet") {
+		resp, err := inventoryClient.NewBlobClient(name).DownloadStream(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("unable to download inventory report %s: %w", name, err)
+		}
+		defer resp.Body.Close()
+		return readInventoryFile(resp.Body, b.ContainerName, prefix, fn)
+	}
+
+	tmp, err := os.CreateTemp("", "inventory-*.parquet")
+	if err != nil {
+		return fmt.Errorf("unable to create a temporary file for inventory report %s: %w", name, err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := inventoryClient.NewBlobClient(name).DownloadFile(ctx, tmp, nil)
+	if err != nil {
+		return fmt.Errorf("unable to download inventory report %s: %w", name, err)
+	}
+	return readParquetInventoryFile(tmp, size, b.ContainerName, prefix, fn)
+}
+
+// forEachInventoryBlob calls fn for every blob under prefix in the newest inventory report. Blobs written after the
+// report started are not in it, so with InventoryDelta the changes since then are read from the change feed and
+// applied on top: blobs deleted or rewritten since the report are taken from the change feed instead
+func (b *BlobArchiver) forEachInventoryBlob(ctx context.Context, prefix string, fn func(*container.BlobItem) error) error {
+	inventoryClient, err := b.createContainerClient(b.ConnectionString, b.InventoryContainer)
+	if err != nil {
+		return fmt.Errorf("failed to create container client: %w", err)
+	}
+	manifest, err := b.newestInventoryReport(ctx, inventoryClient)
+	if err != nil {
+		return err
+	}
+
+	var changed map[string]*container.BlobItem
+	if b.InventoryDelta {
+		if changed, err = b.changesSince(ctx, manifest.InventoryStartTime, prefix); err != nil {
+			return err
+		}
+	}
+
+	var reported int64
+	for _, file := range manifest.Files {
+		err := b.readInventoryBlob(ctx, inventoryClient, file.Blob, prefix, func(blobItem *container.BlobItem) error {
+			if _, ok := changed[*blobItem.Name]; ok {
+				return nil
+			}
+			reported++
+			return fn(blobItem)
+		})
+		if err != nil {
+			return fmt.Errorf("unable to read inventory report %s: %w", file.Blob, err)
+		}
+	}
+
+	var created int64
+	for _, blobItem := range changed {
+		if blobItem == nil {
+			continue
+		}
+		created++
+		if err := fn(blobItem); err != nil {
+			return err
+		}
+	}
+	log.Printf("[%d] blobs listed from the inventory report, [%d] from the change feed, [%d] changed since the report", reported, created, len(changed))
+	return nil
+}
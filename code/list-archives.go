@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ListArchives lists the archives in the destination container, oldest first, optionally only those of one source
+// container taken within a date range. Since and Until are inclusive
+func (b *BlobArchiver) ListArchives() ([]archiveBlob, error) {
+	var since, until time.Time
+	var err error
+	if b.Since != "" {
+		if since, err = parseArchiveDate(b.Since); err != nil {
+			return nil, err
+		}
+	}
+	if b.Until != "" {
+		if until, err = parseArchiveDate(b.Until); err != nil {
+			return nil, err
+		}
+	}
+
+	archives, err := b.listArchives(context.Background(), b.ArchiveSourceContainer)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list archives: %w", err)
+	}
+	var listed []archiveBlob
+	for _, a := range archives {
+		if !since.IsZero() && a.Date.Before(since) {
+			continue
+		}
+		if !until.IsZero() && a.Date.After(until) {
+			continue
+		}
+		listed = append(listed, a)
+	}
+	log.Printf("[%d] archives found in container %s", len(listed), b.DestinationContainerName)
+	return listed, nil
+}
+
+// archiveTags formats the tags of an archive as key=value pairs, the same form they are given on the command line
+func archiveTags(a archiveBlob) string {
+	keys := make([]string, 0, len(a.Tags))
+	for k := range a.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+"="+a.Tags[k])
+	}
+	return strings.Join(parts, ",")
+}
+
+// writeArchives prints the archives as a table, json or csv. The name is the blob path download-tarfile and restore
+// --as-of work with
+func writeArchives(w io.Writer, archives []archiveBlob, format string) error {
+	type jsonArchive struct {
+		Name            string            `json:"name"`
+		SourceContainer string            `json:"sourceContainer"`
+		Date            string            `json:"date"`
+		Size            int64             `json:"size"`
+		Compressed      bool              `json:"compressed"`
+		Manifest        bool              `json:"manifest"`
+		LastModified    time.Time         `json:"lastModified"`
+		Tags            map[string]string `json:"tags"`
+	}
+	list := []jsonArchive{}
+	var rows [][]string
+	for _, a := range archives {
+		list = append(list, jsonArchive{a.Name, a.SourceContainer, a.Date.Format("2006-01-02"), a.Size, a.Compressed, a.HasManifest, a.LastModified, a.Tags})
+		rows = append(rows, []string{a.Date.Format("2006-01-02"), a.SourceContainer, strconv.FormatInt(a.Size, 10),
+			strconv.FormatBool(a.Compressed), strconv.FormatBool(a.HasManifest), archiveTags(a), a.Name})
+	}
+	header := []string{"date", "source", "size", "compressed", "manifest", "tags", "name"}
+	return writeRows(w, format, header, rows, list, func(tw *tabwriter.Writer) {
+		fmt.Fprintln(tw, "DATE\tSOURCE\tSIZE\tCOMPRESSED\tMANIFEST\tTAGS\tNAME")
+		for _, a := range archives {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%v\t%s\t%s\n", a.Date.Format("2006-01-02"), a.SourceContainer, ByteCountSI(a.Size),
+				a.Compressed, a.HasManifest, archiveTags(a), a.Name)
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// the largest page the list blobs API returns
+var maxListResults = int32(5000)
+
+// forEachBlob calls fn for every blob under prefix. A flat listing is one sequential stream of pages, so with more than
+// one list shard the top level prefixes under prefix are found with a hierarchical listing using "/" as the delimiter
+// and each prefix is paged concurrently. fn is always called from the calling goroutine, one blob at a time, so
+// callers need no locking of their own. The order blobs are returned in is only guaranteed with a single shard.
+// When an inventory container is set the blobs are read from the newest inventory report instead of being listed
+func (b *BlobArchiver) forEachBlob(ctx context.Context, containerClient *container.Client, prefix string, include container.ListBlobsInclude, fn func(*container.BlobItem) error) error {
+	if b.InventoryContainer != "" {
+		if include != (container.ListBlobsInclude{}) {
+			return fmt.Errorf("an inventory report cannot be used here, it only lists current blobs and their properties")
+		}
+		return b.forEachInventoryBlob(ctx, prefix, fn)
+	}
+	if b.ListShards <= 1 {
+		pager := containerClient.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+			Prefix:     &prefix,
+			Include:    include,
+			MaxResults: &maxListResults,
+		})
+		for pager.More() {
+			page, err := pager.NextPage(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to list blobs: %w", err)
+			}
+			for _, blobItem := range page.Segment.BlobItems {
+				if err := fn(blobItem); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pageChan := make(chan []*container.BlobItem, b.ListShards)
+	shardChan := make(chan string)
+	errChan := make(chan error, 1)
+	fail := func(err error) {
+		select {
+		case errChan <- err:
+		default:
+		}
+		cancel()
+	}
+	send := func(items []*container.BlobItem) bool {
+		select {
+		case pageChan <- items:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	var wg sync.WaitGroup
+
+	// discover the shards. Blobs directly under the prefix are returned with the prefixes and sent straight on
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(shardChan)
+		pager := containerClient.NewListBlobsHierarchyPager("/", &container.ListBlobsHierarchyOptions{
+			Prefix:     &prefix,
+			Include:    include,
+			MaxResults: &maxListResults,
+		})
+		for pager.More() {
+			page, err := pager.NextPage(ctx)
+			if err != nil {
+				fail(fmt.Errorf("failed to list prefixes: %w", err))
+				return
+			}
+			if len(page.Segment.BlobItems) > 0 && !send(page.Segment.BlobItems) {
+				return
+			}
+			for _, blobPrefix := range page.Segment.BlobPrefixes {
+				select {
+				case shardChan <- *blobPrefix.Name:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	// page each shard with a flat listing
+	for i := 0; i < b.ListShards; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for shard := range shardChan {
+				pager := containerClient.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+					Prefix:     &shard,
+					Include:    include,
+					MaxResults: &maxListResults,
+				})
+				for pager.More() {
+					page, err := pager.NextPage(ctx)
+					if err != nil {
+						fail(fmt.Errorf("failed to list blobs under %s: %w", shard, err))
+						return
+					}
+					if !send(page.Segment.BlobItems) {
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(pageChan)
+	}()
+
+	var fnErr error
+	for items := range pageChan {
+		if fnErr != nil {
+			// drain so the listers are not left blocked sending
+			continue
+		}
+		for _, blobItem := range items {
+			if fnErr = fn(blobItem); fnErr != nil {
+				cancel()
+				break
+			}
+		}
+	}
+	if fnErr != nil {
+		return fnErr
+	}
+	select {
+	case err := <-errChan:
+		return err
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// manifestSuffix is appended to the tar file name for the manifest written alongside every backup
+const manifestSuffix = ".manifest.json"
+
+// archiveManifest is a sidecar written next to the tar file at backup time. It records details of the source
+// container that are not held in the tar file itself
+type archiveManifest struct {
+	SourceContainer string              `json:"sourceContainer"`
+	Created         time.Time           `json:"created"`
+	Compressed      bool                `json:"compressed"`
+	Container       containerProperties `json:"container"`
+	Entries         []manifestEntry     `json:"entries,omitempty"`
+}
+
+// manifestEntry records a blob as it was archived. MD5 is the base64 MD5 of the archived content, computed as it was
+// written to the tar file, so it is set even for blobs uploaded without a Content-MD5
+type manifestEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	ETag    string    `json:"etag,omitempty"`
+	MD5     string    `json:"md5,omitempty"`
+}
+
+// containerProperties are the properties of the source container needed to recreate it
+type containerProperties struct {
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	PublicAccess string            `json:"publicAccess,omitempty"`
+}
+
+// sidecarSuffixes are the files written next to the tar file that are uploaded, downloaded and deleted with it
+var sidecarSuffixes = []string{manifestSuffix, indexSuffix}
+
+func manifestFile(tarFile string) string {
+	return tarFile + manifestSuffix
+}
+
+func readManifest(file string) (*archiveManifest, error) {
+	f, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open manifest : %w", err)
+	}
+	m := new(archiveManifest)
+	if err := json.Unmarshal(f, m); err != nil {
+		return nil, fmt.Errorf("unable to read manifest %s : %w", file, err)
+	}
+	return m, nil
+}
+
+func writeManifest(file string, m *archiveManifest) error {
+	f, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, f, 0600)
+}
+
+// getContainerProperties reads the metadata and public access level of a container
+func getContainerProperties(ctx context.Context, containerClient *container.Client) (containerProperties, error) {
+	props := containerProperties{Metadata: map[string]string{}}
+	resp, err := containerClient.GetProperties(ctx, nil)
+	if err != nil {
+		return props, err
+	}
+	for k, v := range resp.Metadata {
+		if v != nil {
+			props.Metadata[k] = *v
+		}
+	}
+	if resp.BlobPublicAccess != nil {
+		props.PublicAccess = string(*resp.BlobPublicAccess)
+	}
+	return props, nil
+}
+
+// writeBackupManifest records the source container properties and the archived blobs next to the tar file
+func (b *BlobArchiver) writeBackupManifest(ctx context.Context, containerClient *container.Client, entries []manifestEntry) error {
+	props, err := getContainerProperties(ctx, containerClient)
+	if err != nil {
+		log.Printf("unable to read properties of container %s - they will not be recorded in the manifest : %v", b.ContainerName, err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return writeManifest(manifestFile(b.TarFile()), &archiveManifest{
+		SourceContainer: b.ContainerName,
+		Created:         time.Now().UTC(),
+		Compressed:      b.Compression,
+		Container:       props,
+		Entries:         entries,
+	})
+}
+
+// readRemoteManifest reads the manifest of an archive blob. It returns nil if the archive has no manifest
+func readRemoteManifest(ctx context.Context, containerClient *container.Client, blobName string) (*archiveManifest, error) {
+	resp, err := containerClient.NewBlobClient(manifestFile(blobName)).DownloadStream(ctx, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to download manifest of %s: %w", blobName, err)
+	}
+	defer resp.Body.Close()
+	m := new(archiveManifest)
+	if err := json.NewDecoder(resp.Body).Decode(m); err != nil {
+		return nil, fmt.Errorf("unable to read manifest of %s: %w", blobName, err)
+	}
+	return m, nil
+}
+
+// archiveManifest reads the manifest of the tar file or, with RemoteTarFile, the archive blob
+func (b *BlobArchiver) archiveManifest(ctx context.Context) (*archiveManifest, error) {
+	if !b.RemoteTarFile {
+		return readManifest(manifestFile(b.TarFile()))
+	}
+	containerClient, err := b.createContainerClient(b.DestinationConnectionString, b.DestinationContainerName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container client: %w", err)
+	}
+	m, err := readRemoteManifest(ctx, containerClient, b.TarFileName)
+	if err == nil && m == nil {
+		return nil, fmt.Errorf("archive %s has no manifest", b.TarFileName)
+	}
+	return m, err
+}
+
+// downloadSidecars fetches the manifest and index of an archive blob if it has them. A missing sidecar is not an
+// error as archives taken before they were written do not have them
+func (b *BlobArchiver) downloadSidecars(ctx context.Context, connectionString, containerName, blobName, destination string) error {
+	containerClient, err := b.createContainerClient(connectionString, containerName)
+	if err != nil {
+		return fmt.Errorf("failed to create container client: %w", err)
+	}
+	for _, suffix := range sidecarSuffixes {
+		if err := downloadSidecar(ctx, containerClient, blobName+suffix, destination+suffix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func downloadSidecar(ctx context.Context, containerClient *container.Client, blobName, destination string) error {
+	resp, err := containerClient.NewBlobClient(blobName).DownloadStream(ctx, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		log.Printf("archive has no [%s]", blobName)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to download %s: %w", blobName, err)
+	}
+	defer resp.Body.Close()
+
+	f, err := os.Create(destination)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %w", destination, err)
+	}
+	defer f.Close()
+	if _, err := f.ReadFrom(resp.Body); err != nil {
+		return fmt.Errorf("unable to download %s: %w", blobName, err)
+	}
+	return nil
+}
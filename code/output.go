@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// writeRows writes a command's output as json (jsonValue), csv (header and rows) or a table. The table is laid out by
+// the caller through table since it usually shows sizes and dates for people rather than the raw csv values
+func writeRows(w io.Writer, format string, header []string, rows [][]string, jsonValue any, table func(tw *tabwriter.Writer)) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(jsonValue)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write(header)
+		cw.WriteAll(rows)
+		return cw.Error()
+	case "table", "":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		table(tw)
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown output format [%s] - expected table, json or csv", format)
+}
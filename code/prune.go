@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	bolt "go.etcd.io/bbolt"
+)
+
+// retentionPolicy is a grandfather-father-son policy - the newest archive in each of the last Daily days, Weekly ISO
+// weeks, Monthly months and Yearly years that have an archive is kept
+type retentionPolicy struct {
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+}
+
+func (r retentionPolicy) String() string {
+	return fmt.Sprintf("[daily: %d][weekly: %d][monthly: %d][yearly: %d]", r.Daily, r.Weekly, r.Monthly, r.Yearly)
+}
+
+// keep returns the names of the archives the policy keeps. archives must be sorted oldest first
+func (r retentionPolicy) keep(archives []archiveBlob) map[string]string {
+	kept := map[string]string{}
+	periods := []struct {
+		name  string
+		count int
+		key   func(time.Time) string
+	}{
+		{"daily", r.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", r.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{"monthly", r.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", r.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+	for _, period := range periods {
+		seen := map[string]bool{}
+		for i := len(archives) - 1; i >= 0 && len(seen) < period.count; i-- {
+			key := period.key(archives[i].Date)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if _, ok := kept[archives[i].Name]; !ok {
+				kept[archives[i].Name] = period.name
+			}
+		}
+	}
+	return kept
+}
+
+// isSuccessful reports whether the archive finished uploading. The manifest is only uploaded once the archive has
+// been, and the source container and date tags are set last, whatever tar file tags were given. A failure to set them
+// fails the upload, so an archive with neither did not finish
+func (a archiveBlob) isSuccessful() bool {
+	return (a.Tags[archiveSourceContainerTag] != "" && a.Tags[archiveDateTag] != "") || a.HasManifest
+}
+
+// PruneArchives deletes the archives of the source container from the destination container that fall outside the
+// retention policy, along with their manifests and indexes. The newest successful archive is always kept. Safety
+// archives are not covered by the policy and are deleted once their retain until date has passed
+func (b *BlobArchiver) PruneArchives() error {
+	ctx := context.Background()
+	archives, err := b.listArchives(ctx, b.ContainerName)
+	if err != nil {
+		return fmt.Errorf("unable to list archives: %w", err)
+	}
+
+	var backups []archiveBlob
+	var remove []archiveBlob
+	today := time.Now().Format("2006-01-02")
+	for _, a := range archives {
+		if !a.isSafetyArchive() {
+			backups = append(backups, a)
+			continue
+		}
+		if retainUntil := a.Tags[safetyRetainUntilTag]; retainUntil != "" && retainUntil < today {
+			remove = append(remove, a)
+		} else {
+			log.Printf("keeping   [%s] safety archive retained until %s", a.Name, retainUntil)
+		}
+	}
+
+	kept := b.Retention.keep(backups)
+	for i := len(backups) - 1; i >= 0; i-- {
+		if backups[i].isSuccessful() {
+			if _, ok := kept[backups[i].Name]; !ok {
+				kept[backups[i].Name] = "newest successful"
+			}
+			break
+		}
+	}
+	for _, a := range backups {
+		if reason, ok := kept[a.Name]; ok {
+			log.Printf("keeping   [%s] %s", a.Name, reason)
+			continue
+		}
+		remove = append(remove, a)
+	}
+
+	log.Printf("retention policy %s keeps [%d] of [%d] archives of container %s", b.Retention, len(kept), len(backups), b.ContainerName)
+	if b.DryRun {
+		for _, a := range remove {
+			log.Printf("dry run: would delete [%s] and its manifest and index", a.Name)
+		}
+		log.Printf("dry run: [%d] archives would be deleted", len(remove))
+		return nil
+	}
+
+	containerClient, err := b.createContainerClient(b.DestinationConnectionString, b.DestinationContainerName)
+	if err != nil {
+		return fmt.Errorf("failed to create container client: %w", err)
+	}
+	var failed int
+	var deleted []string
+	for _, a := range remove {
+		if err := deleteArchiveBlobs(ctx, containerClient, a.Name); err != nil {
+			log.Printf("failed to delete [%s]: %v", a.Name, err)
+			failed++
+			continue
+		}
+		log.Printf("deleted   [%s]", a.Name)
+		deleted = append(deleted, a.Name)
+	}
+	log.Printf("[%d] archives deleted, [%d] failed", len(remove)-failed, failed)
+	err = b.updateCatalog(func(tx *bolt.Tx) error {
+		for _, name := range deleted {
+			if err := removeCatalogArchive(tx, "archive:"+name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("unable to remove the deleted archives from the catalog: %v", err)
+	}
+	if failed > 0 {
+		return fmt.Errorf("[%d] archives could not be deleted", failed)
+	}
+	return nil
+}
+
+// deleteArchiveBlobs deletes an archive blob and its sidecar blobs. A missing sidecar is not an error
+func deleteArchiveBlobs(ctx context.Context, containerClient *container.Client, name string) error {
+	deleteSnapshots := blob.DeleteSnapshotsOptionTypeInclude
+	if _, err := containerClient.NewBlobClient(name).Delete(ctx, &blob.DeleteOptions{DeleteSnapshots: &deleteSnapshots}); err != nil {
+		return err
+	}
+	for _, suffix := range sidecarSuffixes {
+		sidecar := name + suffix
+		_, err := containerClient.NewBlobClient(sidecar).Delete(ctx, &blob.DeleteOptions{DeleteSnapshots: &deleteSnapshots})
+		if err != nil && !bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return fmt.Errorf("archive deleted but not %s: %w", sidecar, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"maps"
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicyKeep(t *testing.T) {
+	archive := func(name, date string) archiveBlob {
+		d, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return archiveBlob{Name: name, Date: d}
+	}
+	tests := []struct {
+		name     string
+		policy   retentionPolicy
+		archives []archiveBlob
+		want     map[string]string
+	}{
+		{
+			name:     "nothing kept without a policy",
+			archives: []archiveBlob{archive("a", "2025-01-01"), archive("b", "2025-01-02")},
+			want:     map[string]string{},
+		},
+		{
+			name:   "newest archive of each day",
+			policy: retentionPolicy{Daily: 2},
+			archives: []archiveBlob{archive("a", "2025-01-01"), archive("b", "2025-01-02"), archive("c", "2025-01-02"),
+				archive("d", "2025-01-03")},
+			want: map[string]string{"c": "daily", "d": "daily"},
+		},
+		{
+			name:   "weeks are ISO weeks and archives kept daily are not counted twice",
+			policy: retentionPolicy{Daily: 1, Weekly: 2},
+			archives: []archiveBlob{archive("a", "2024-12-20"), archive("b", "2024-12-23"), archive("c", "2024-12-27"),
+				archive("d", "2024-12-30")},
+			want: map[string]string{"c": "weekly", "d": "daily"},
+		},
+		{
+			name:   "monthly and yearly",
+			policy: retentionPolicy{Monthly: 2, Yearly: 2},
+			archives: []archiveBlob{archive("a", "2023-06-01"), archive("b", "2023-12-15"), archive("c", "2024-01-10"),
+				archive("d", "2024-02-01")},
+			want: map[string]string{"b": "yearly", "c": "monthly", "d": "monthly"},
+		},
+		{
+			name:     "fewer archives than the policy covers",
+			policy:   retentionPolicy{Daily: 7, Weekly: 4, Monthly: 12, Yearly: 5},
+			archives: []archiveBlob{archive("a", "2025-01-01")},
+			want:     map[string]string{"a": "daily"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.keep(tt.archives); !maps.Equal(got, tt.want) {
+				t.Errorf("keep() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
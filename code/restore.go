@@ -5,37 +5,187 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/md5"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 	"github.com/schollz/progressbar/v3"
 )
 
 // uploadBlob handles the upload of a single blob to Azure
 func uploadBlob(client *azblob.Client, containerName string, file tarFileStruct) error {
-	_, err := client.UploadStream(context.Background(), containerName, file.Name, file.Content, nil)
+	_, err := client.UploadStream(context.Background(), containerName, file.Name, file.Content, &azblob.UploadStreamOptions{
+		HTTPHeaders: &blob.HTTPHeaders{BlobContentMD5: file.MD5},
+	})
 	return err
 }
 
-// RestoreFromTarFile restores blobs from a tar archive using parallel uploads
-func (b *BlobArchiver) RestoreFromTarFile() error {
-	log.Printf("Opening tarfile [%s]", b.TarFile())
+// restoreFailure records a single tar entry that could not be uploaded
+type restoreFailure struct {
+	Entry string `json:"entry"`
+	Blob  string `json:"blob"`
+	Error string `json:"error"`
+}
+
+// restoreFailureList is the machine readable list of failed entries written at the end of a restore.
+// It can be handed back to restore with --retry-failed to upload only the entries that failed. TarFile is the full
+// path of the tar file, including the path it was restored from
+type restoreFailureList struct {
+	TarFile    string           `json:"tarFile"`
+	Remote     bool             `json:"remote,omitempty"`
+	Compressed bool             `json:"compressed"`
+	Container  string           `json:"container"`
+	Prefix     string           `json:"prefix,omitempty"`
+	Failed     []restoreFailure `json:"failed"`
+}
+
+// applyRetryList restores from the tar file, container and prefix recorded in a failed entry list, refusing any that
+// were given differently
+func (b *BlobArchiver) applyRetryList(list *restoreFailureList) error {
+	if list.Container != b.ContainerName {
+		return fmt.Errorf("the failed entries were restored to container %s, not %s", list.Container, b.ContainerName)
+	}
+	if list.Prefix != b.prefix {
+		return fmt.Errorf("the failed entries were restored with prefix [%s], not [%s]", list.Prefix, b.prefix)
+	}
+	if list.Remote {
+		if b.TarFileName != "" && b.TarFileName != list.TarFile {
+			return fmt.Errorf("the failed entries were restored from archive %s, not %s", list.TarFile, b.TarFileName)
+		}
+		b.RemoteTarFile = true
+		b.TarFileName = list.TarFile
+		return nil
+	}
+	if b.TarFileName != "" {
+		given, err := filepath.Abs(b.TarFile())
+		if err != nil {
+			return err
+		}
+		recorded, err := filepath.Abs(list.TarFile)
+		if err != nil {
+			return err
+		}
+		if given != recorded {
+			return fmt.Errorf("the failed entries were restored from %s, not %s", list.TarFile, b.TarFile())
+		}
+	}
+	// the recorded tar file already includes the path
+	b.Path = ""
+	b.TarFileName = list.TarFile
+	b.Compression = list.Compressed
+	return nil
+}
+
+func readRestoreFailureList(file string) (*restoreFailureList, error) {
+	f, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open failed entry list : %w", err)
+	}
+	list := new(restoreFailureList)
+	if err := json.Unmarshal(f, list); err != nil {
+		return nil, fmt.Errorf("unable to read failed entry list %s : %w", file, err)
+	}
+	return list, nil
+}
 
-	// Open tar file for reading
-	tarFile, err := os.Open(b.TarFile())
+func writeRestoreFailureList(file string, list *restoreFailureList) error {
+	f, err := json.MarshalIndent(list, "", "  ")
 	if err != nil {
-		return fmt.Errorf("failed to open tar file: %w", err)
+		return err
+	}
+	return os.WriteFile(file, f, 0600)
+}
+
+// failedListFile is where the failed entries of a restore are written - defaults to alongside the tar file, or in the
+// path for an archive blob
+func (b *BlobArchiver) failedListFile() string {
+	if b.FailedListFile != "" {
+		return b.FailedListFile
+	}
+	if b.RemoteTarFile {
+		return filepath.Join(b.Path, path.Base(b.TarFileName)+".failed.json")
+	}
+	return b.TarFile() + ".failed.json"
+}
+
+// restoredBlobName is the name a tar entry is restored to
+func (b *BlobArchiver) restoredBlobName(entry string) string {
+	if b.prefix != "" {
+		return fmt.Sprintf("%s/%s", b.prefix, entry)
+	}
+	return entry
+}
+
+// RestoreFromTarFile restores blobs from a tar archive using parallel uploads. With RemoteTarFile, the entries selected
+// by the include globs or the failed entry list are read from the archive blob in the destination container with
+// ranged reads, using its index
+func (b *BlobArchiver) RestoreFromTarFile() error {
+	// when retrying, only the entries in the failed list are uploaded
+	var retryEntries map[string]bool
+	if b.RetryFailedFile != "" {
+		list, err := readRestoreFailureList(b.RetryFailedFile)
+		if err != nil {
+			return err
+		}
+		if err := b.applyRetryList(list); err != nil {
+			return err
+		}
+		retryEntries = make(map[string]bool, len(list.Failed))
+		for _, f := range list.Failed {
+			retryEntries[f.Entry] = false
+		}
+		log.Printf("retrying [%d] failed entries from %s", len(retryEntries), b.RetryFailedFile)
 	}
-	defer tarFile.Close()
-	tarfileStats, err := tarFile.Stat()
+
+	filter, err := b.entryFilter()
 	if err != nil {
-		return fmt.Errorf("failed to get status of tar file: %w", err)
+		return err
+	}
+
+	// a selective restore reads just the entries it needs when the archive has an index
+	var index *archiveIndex
+	if len(b.Include) > 0 || retryEntries != nil {
+		if index, err = b.archiveIndexIfAny(context.Background()); err != nil {
+			return err
+		}
+	}
+
+	var tarFile *os.File
+	var tarfileSize int64 = -1
+	if b.RemoteTarFile {
+		// reading every entry with its own ranged read would decompress most of the archive many times over
+		if len(b.Include) == 0 && retryEntries == nil {
+			return fmt.Errorf("restore --remote only reads the entries selected with --include - download the archive to restore all of it")
+		}
+		if index == nil {
+			return fmt.Errorf("archive %s has no index, so its entries cannot be read on their own - download it to restore from it", b.TarFileName)
+		}
+		log.Printf("Reading archive [%s] from container %s", b.TarFileName, b.DestinationContainerName)
+	} else {
+		log.Printf("Opening tarfile [%s]", b.TarFile())
+
+		// Open tar file for reading
+		tarFile, err = os.Open(b.TarFile())
+		if err != nil {
+			return fmt.Errorf("failed to open tar file: %w", err)
+		}
+		defer tarFile.Close()
+		tarfileStats, err := tarFile.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to get status of tar file: %w", err)
+		}
+		tarfileSize = tarfileStats.Size()
 	}
-	tarfileSize := tarfileStats.Size()
 
 	// Create Azure Blob Storage client
 	client, err := azblob.NewClientFromConnectionString(b.ConnectionString, nil)
@@ -44,19 +194,45 @@ func (b *BlobArchiver) RestoreFromTarFile() error {
 	}
 	log.Print("Azure storage client created")
 
-	var tarReader *tar.Reader
-	var gzipReader *gzip.Reader
+	// the container is created first, so the safety backup and a resumed restore can list it
+	if b.CreateContainer {
+		var props *containerProperties
+		if b.ApplyContainerProperties {
+			manifest, err := b.archiveManifest(context.Background())
+			if err != nil {
+				return fmt.Errorf("container properties recorded at backup time are not available: %w", err)
+			}
+			props = &manifest.Container
+		}
+		if err := b.createContainerIfMissing(context.Background(), props); err != nil {
+			return err
+		}
+	}
 
-	if b.Compression {
-		gzipReader, err = gzip.NewReader(tarFile)
+	if !b.SkipSafetyBackup {
+		overwritten, err := b.overwrittenBlobs(context.Background(), filter, retryEntries, index)
 		if err != nil {
-			log.Fatal(err)
+			return fmt.Errorf("unable to find the blobs the restore would overwrite: %w", err)
 		}
-		tarReader = tar.NewReader(gzipReader)
-	} else {
-		tarReader = tar.NewReader(tarFile)
+		if _, err := b.safetyBackup(overwritten, "restore"); err != nil {
+			return fmt.Errorf("nothing has been restored: %w", err)
+		}
+	}
 
+	// a resumed restore skips entries that were already uploaded with the same size and content
+	var existing map[string]*container.BlobItem
+	if b.resumeRestore {
+		containerClient, err := b.createContainerClient(b.ConnectionString, b.ContainerName)
+		if err != nil {
+			return fmt.Errorf("failed to create container client: %w", err)
+		}
+		existing, err = listBlobs(context.Background(), containerClient, b.prefix)
+		if err != nil {
+			return err
+		}
+		log.Printf("resuming restore - [%d] blobs already in container %s", len(existing), b.ContainerName)
 	}
+
 	numWorkers := b.Workers
 	// Channel to send tar file contents to worker goroutines
 	fileChan := make(chan tarFileStruct, numWorkers) // Buffered channel
@@ -64,6 +240,11 @@ func (b *BlobArchiver) RestoreFromTarFile() error {
 	// WaitGroup to track worker progress
 	var wg sync.WaitGroup
 
+	// failed uploads are collected by the workers so they can be retried later
+	var failedMutex sync.Mutex
+	var failures []restoreFailure
+	var entries int
+
 	// Worker pool for parallel uploads
 	for i := 0; i < numWorkers; i++ {
 		wg.Add(1)
@@ -73,39 +254,91 @@ func (b *BlobArchiver) RestoreFromTarFile() error {
 				err := uploadBlob(client, b.ContainerName, file)
 				if err != nil {
 					log.Printf("Failed to upload %s: %v", file.Name, err)
+					failedMutex.Lock()
+					failures = append(failures, restoreFailure{Entry: file.Entry, Blob: file.Name, Error: err.Error()})
+					failedMutex.Unlock()
 				}
 			}
 		}()
 	}
 	// testing bug where gzip file unzipped is larger than the tarFileSizeLimit
-	if b.Compression {
+	// a retry skips most of the archive so the size is no use as a total either
+	if b.Compression || retryEntries != nil {
 		tarfileSize = -1
 	}
 	bar := progressbar.DefaultBytes(tarfileSize, "restoring tarfile")
 
-	// Read tar file and send files to channel
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
+	// send reads an entry and hands it to the workers, skipping those that are filtered out or already restored
+	send := func(header *tar.Header, r io.Reader) error {
+		if !filter.Match(header.Name) {
+			return nil
 		}
-		if err != nil {
-			return fmt.Errorf("failed to read tar file: %w", err)
+		if retryEntries != nil {
+			if _, ok := retryEntries[header.Name]; !ok {
+				return nil
+			}
+			retryEntries[header.Name] = true
 		}
-
-		blobName := header.Name
-		if b.prefix != "" {
-			blobName = fmt.Sprintf("%s/%s", b.prefix, blobName)
+		blobName := b.restoredBlobName(header.Name)
+		item, exists := existing[blobName]
+		if exists && *item.Properties.ContentLength != header.Size {
+			exists = false
 		}
 
 		// Read the file content into a buffer
 		var buf bytes.Buffer
-		if _, err := io.Copy(io.MultiWriter(&buf, bar), tarReader); err != nil {
+		if _, err := io.Copy(io.MultiWriter(&buf, bar), r); err != nil {
 			return fmt.Errorf("failed to copy tar file content: %w", err)
 		}
+		sum := md5.Sum(buf.Bytes())
+		if exists && bytes.Equal(item.Properties.ContentMD5, sum[:]) {
+			return nil
+		}
+		entries++
 
 		// Send extracted file details to worker goroutines
-		fileChan <- tarFileStruct{Name: blobName, Content: bytes.NewReader(buf.Bytes())}
+		fileChan <- tarFileStruct{Name: blobName, Entry: header.Name, Content: bytes.NewReader(buf.Bytes()), MD5: sum[:]}
+		return nil
+	}
+
+	if index != nil {
+		log.Printf("reading the selected entries using the index of %s", b.TarFile())
+		match := func(name string) bool {
+			if retryEntries != nil {
+				if _, ok := retryEntries[name]; !ok {
+					return false
+				}
+			}
+			return filter.Match(name)
+		}
+		if err := b.readIndexedEntries(context.Background(), index, match, send); err != nil {
+			return err
+		}
+	} else {
+		var tarReader *tar.Reader
+		if b.Compression {
+			gzipReader, err := gzip.NewReader(tarFile)
+			if err != nil {
+				return fmt.Errorf("failed to read compressed tar file: %w", err)
+			}
+			tarReader = tar.NewReader(gzipReader)
+		} else {
+			tarReader = tar.NewReader(tarFile)
+		}
+
+		// Read tar file and send files to channel
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read tar file: %w", err)
+			}
+			if err := send(header, tarReader); err != nil {
+				return err
+			}
+		}
 	}
 
 	// Close the channel to signal workers no more files will come
@@ -114,6 +347,109 @@ func (b *BlobArchiver) RestoreFromTarFile() error {
 	// Wait for all uploads to complete
 	wg.Wait()
 
+	// entries in the retry list that are no longer in the archive can never be restored so report them as failed
+	for entry, found := range retryEntries {
+		if !found {
+			failures = append(failures, restoreFailure{Entry: entry, Error: "entry not found in tar file"})
+		}
+	}
+
+	if len(failures) > 0 {
+		failedList := b.failedListFile()
+		tarFileName := b.TarFile()
+		if b.RemoteTarFile {
+			tarFileName = b.TarFileName
+		}
+		if err := writeRestoreFailureList(failedList, &restoreFailureList{
+			TarFile:    tarFileName,
+			Remote:     b.RemoteTarFile,
+			Compressed: b.Compression,
+			Container:  b.ContainerName,
+			Prefix:     b.prefix,
+			Failed:     failures,
+		}); err != nil {
+			log.Printf("unable to write failed entry list %s : %v", failedList, err)
+		}
+		return fmt.Errorf("[%d] of [%d] entries failed to restore to container %s - failed entries written to %s, use --retry-failed to retry them",
+			len(failures), entries, b.ContainerName, failedList)
+	}
+
+	// every entry of the list has now been restored, so it would only retry them again
+	if b.RetryFailedFile != "" {
+		if err := os.Remove(b.RetryFailedFile); err != nil {
+			log.Printf("unable to remove failed entry list %s : %v", b.RetryFailedFile, err)
+		}
+	}
 	log.Printf("Tar file restored to the source container %s", b.ContainerName)
 	return nil
 }
+
+// RestoreAsOf restores the source container to the state it was in at a point in time. The newest archive of the source
+// container taken on or before asOf is downloaded from the destination container to the path and restored. Every
+// archive is a full archive, so it alone holds the state of the container
+func (b *BlobArchiver) RestoreAsOf(asOf string) error {
+	ctx := context.Background()
+	if b.RemoteTarFile {
+		return fmt.Errorf("--as-of finds the archive itself, so it cannot be used with --remote")
+	}
+
+	target, err := parseArchiveDate(asOf)
+	if err != nil {
+		return err
+	}
+	// a date on its own means the state at the end of that day
+	if len(asOf) == len("2006-01-02") {
+		target = target.Add(24*time.Hour - time.Nanosecond)
+	}
+
+	archives, err := b.listArchives(ctx, b.ContainerName)
+	if err != nil {
+		return fmt.Errorf("unable to list archives: %w", err)
+	}
+	var chosen *archiveBlob
+	for i := range archives {
+		// safety archives only hold the blobs that were about to change, so they are never a point in time
+		if archives[i].isSafetyArchive() {
+			continue
+		}
+		if !archives[i].Date.After(target) {
+			chosen = &archives[i]
+		}
+	}
+	if chosen == nil {
+		return fmt.Errorf("no archive of container %s found on or before %s", b.ContainerName, asOf)
+	}
+	log.Printf("restoring container %s as of %s from archive [%s] taken %s",
+		b.ContainerName, asOf, chosen.Name, chosen.Date.Format("2006-01-02"))
+
+	if b.Path != "" {
+		if err := os.MkdirAll(b.Path, os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+	}
+	localTarFile := filepath.Join(b.Path, path.Base(chosen.Name))
+	if err := b.DownloadBlobToBuffer(ctx,
+		b.DestinationConnectionString,
+		b.DestinationContainerName,
+		chosen.Name,
+		localTarFile,
+	); err != nil {
+		return fmt.Errorf("unable to download archive %s: %w", chosen.Name, err)
+	}
+	if err := b.downloadSidecars(ctx,
+		b.DestinationConnectionString,
+		b.DestinationContainerName,
+		chosen.Name,
+		localTarFile,
+	); err != nil {
+		return err
+	}
+
+	b.Path = ""
+	b.TarFileName = localTarFile
+	b.Compression = chosen.Compressed
+	if b.Staged {
+		return b.StagedRestore()
+	}
+	return b.RestoreFromTarFile()
+}
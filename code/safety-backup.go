@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// safety archives are tagged with this name instead of the default "BlobArchive", so they are never mistaken for a
+// scheduled backup, and with the date they must be kept until. Only prune of the same source container acts on the
+// date, so a safety archive is kept until it runs
+const (
+	safetyArchiveName    = "SafetyArchive"
+	safetyRetainUntilTag = "RetainUntil"
+	safetyReasonTag      = "Reason"
+)
+
+func (a archiveBlob) isSafetyArchive() bool {
+	return a.Tags["Name"] == safetyArchiveName
+}
+
+// safetyBackup archives the blobs that are about to be deleted or overwritten and uploads the archive to the
+// destination container. It returns the ETag of every blob as it was archived, so a delete can leave alone any blob
+// changed since. An error means the destructive operation must not go ahead
+func (b *BlobArchiver) safetyBackup(blobs []*container.BlobItem, reason string) (map[string]string, error) {
+	if len(blobs) == 0 {
+		log.Printf("safety backup: no existing blobs in container %s will be affected", b.ContainerName)
+		return map[string]string{}, nil
+	}
+	if b.DestinationConnectionString == "" || b.DestinationContainerName == "" {
+		return nil, fmt.Errorf("a destination container is needed for the safety backup - use --skip-safety-backup to run without one")
+	}
+
+	now := time.Now()
+	ext := "tar"
+	if b.Compression {
+		ext = "tgz"
+	}
+	safety := *b
+	// the safety archive is written next to the tar file being restored, or the backup path when deleting or restoring
+	// from an archive blob
+	safety.Path = filepath.Dir(b.TarFile())
+	if b.RemoteTarFile {
+		safety.Path = b.Path
+	}
+	safety.RemoteTarFile = false
+	safety.TarFileName = fmt.Sprintf("safety-%s-%s.%s", b.ContainerName, now.UTC().Format("20060102T150405Z"), ext)
+	safety.TimeStr = now.Format("2006-01-02")
+	safety.destinationPath = "safety"
+	safety.TarFileTags = StringMapFlag{
+		"Name":               safetyArchiveName,
+		safetyReasonTag:      reason,
+		safetyRetainUntilTag: now.AddDate(0, 0, b.SafetyRetentionDays).Format("2006-01-02"),
+	}
+
+	log.Printf("safety backup: archiving [%d] blobs from container %s before %s", len(blobs), b.ContainerName, reason)
+	failed, err := safety.streamBlobsToTar(blobs)
+	if err != nil {
+		return nil, fmt.Errorf("safety backup failed: %w", err)
+	}
+	if failed > 0 {
+		return nil, fmt.Errorf("safety backup failed: [%d] batches of blobs could not be archived", failed)
+	}
+	manifest, err := readManifest(manifestFile(safety.TarFile()))
+	if err != nil {
+		return nil, fmt.Errorf("safety backup failed: %w", err)
+	}
+	etags := map[string]string{}
+	for _, e := range manifest.Entries {
+		etags[e.Name] = e.ETag
+	}
+	if err := safety.CopyArchiveToStorageContainer(); err != nil {
+		return nil, fmt.Errorf("safety backup failed to upload: %w", err)
+	}
+
+	// the uploaded copy is the one that is kept, so the local files only take up space
+	for _, suffix := range append([]string{""}, sidecarSuffixes...) {
+		f := safety.TarFile() + suffix
+		if err := os.Remove(f); err != nil {
+			log.Printf("unable to remove local safety backup file %s: %v", f, err)
+		}
+	}
+	log.Printf("safety backup: archive %s uploaded, retained until %s - prune of container %s deletes it after that",
+		safety.TarFile(), safety.TarFileTags[safetyRetainUntilTag], b.ContainerName)
+	return etags, nil
+}
+
+// overwrittenBlobs lists the blobs in the container that a restore of the tar file would overwrite. The entry names
+// are taken from the index when there is one, otherwise from the tar file
+func (b *BlobArchiver) overwrittenBlobs(ctx context.Context, filter *nameFilter, retryEntries map[string]bool, index *archiveIndex) ([]*container.BlobItem, error) {
+	containerClient, err := b.createContainerClient(b.ConnectionString, b.ContainerName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container client: %w", err)
+	}
+	existing, err := listBlobs(ctx, containerClient, b.prefix)
+	// a container that does not exist yet has nothing to overwrite
+	if bloberror.HasCode(err, bloberror.ContainerNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) == 0 {
+		return nil, nil
+	}
+
+	var blobs []*container.BlobItem
+	add := func(name string) {
+		if !filter.Match(name) {
+			return
+		}
+		if _, ok := retryEntries[name]; retryEntries != nil && !ok {
+			return
+		}
+		if blobItem, ok := existing[b.restoredBlobName(name)]; ok {
+			blobs = append(blobs, blobItem)
+		}
+	}
+	if index != nil {
+		for _, e := range index.Entries {
+			add(e.Name)
+		}
+		return blobs, nil
+	}
+
+	tarReader, closeTarFile, err := openTarFile(b.TarFile(), b.Compression)
+	if err != nil {
+		return nil, err
+	}
+	defer closeTarFile()
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar file: %w", err)
+		}
+		add(header.Name)
+	}
+	return blobs, nil
+}
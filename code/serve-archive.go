@@ -0,0 +1,257 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// archiveBrowser serves the directory tree of an archive read only. The entries are listed once at startup
+type archiveBrowser struct {
+	b       *BlobArchiver
+	index   *archiveIndex
+	entries []archiveEntry
+	// user and password are the basic auth credentials. Requests are not authenticated when user is empty
+	user     string
+	password string
+}
+
+// browserItem is a row of a directory listing - either a directory or a file
+type browserItem struct {
+	Name    string
+	Link    string
+	Dir     bool
+	Size    string
+	ModTime string
+}
+
+var browserTemplate = template.Must(template.New("browse").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Archive}} - /{{.Dir}}</title>
+<style>body{font-family:sans-serif} td{padding:2px 12px} td.size{text-align:right}</style>
+</head>
+<body>
+<h2>{{.Archive}}</h2>
+<p>{{range .Crumbs}}<a href="{{.Link}}">{{.Name}}</a> / {{end}}</p>
+<table>
+<tr><th align="left">Name</th><th>Size</th><th>Modified</th></tr>
+{{range .Items}}<tr><td>{{if .Dir}}&#128193; {{end}}<a href="{{.Link}}">{{.Name}}</a></td><td class="size">{{.Size}}</td><td>{{.ModTime}}</td></tr>
+{{end}}</table>
+<p>[{{len .Items}}] items</p>
+</body>
+</html>
+`))
+
+// ServeArchive starts a read only HTTP server to browse the entries of a local tar file, or an archive in the
+// destination container, and download single entries. Entries are listed from the manifest, or the tar headers if
+// there is none, and downloaded using the index when there is one. It only returns if the server fails
+func (b *BlobArchiver) ServeArchive(listen, basicAuth string) error {
+	ctx := context.Background()
+	browser := &archiveBrowser{b: b}
+	if basicAuth != "" {
+		user, password, ok := strings.Cut(basicAuth, ":")
+		if !ok || user == "" || password == "" {
+			return fmt.Errorf("basic auth must be given as user:password")
+		}
+		browser.user, browser.password = user, password
+	}
+
+	var err error
+	if browser.entries, err = b.InspectArchive(); err != nil {
+		return fmt.Errorf("unable to list the entries of %s: %w", b.archiveName(), err)
+	}
+	sort.Slice(browser.entries, func(i, j int) bool { return browser.entries[i].Name < browser.entries[j].Name })
+	if browser.index, err = b.archiveIndexIfAny(ctx); err != nil {
+		return err
+	}
+	if browser.index == nil {
+		log.Printf("%s has no index - every download reads the archive up to the entry", b.archiveName())
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/browse/", http.StatusFound)
+	})
+	mux.HandleFunc("/browse/", browser.browse)
+	mux.HandleFunc("/download/", browser.download)
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           browser.guard(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if browser.user == "" {
+		log.Printf("serving [%d] entries of %s on http://%s/ without authentication", len(browser.entries), b.archiveName(), listen)
+	} else {
+		log.Printf("serving [%d] entries of %s on http://%s/ with basic auth", len(browser.entries), b.archiveName(), listen)
+	}
+	return server.ListenAndServe()
+}
+
+// guard logs every request, refuses anything but GET and HEAD and checks the basic auth credentials if they are set
+func (a *archiveBrowser) guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s %s", r.RemoteAddr, r.Method, r.URL.Path)
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "the archive is read only", http.StatusMethodNotAllowed)
+			return
+		}
+		if a.user != "" {
+			user, password, ok := r.BasicAuth()
+			// the hashes are compared so the time taken does not depend on the length of the credentials
+			userHash, wantUser := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(a.user))
+			passwordHash, wantPassword := sha256.Sum256([]byte(password)), sha256.Sum256([]byte(a.password))
+			userOK := subtle.ConstantTimeCompare(userHash[:], wantUser[:]) == 1
+			passwordOK := subtle.ConstantTimeCompare(passwordHash[:], wantPassword[:]) == 1
+			if !ok || !userOK || !passwordOK {
+				w.Header().Set("WWW-Authenticate", `Basic realm="archive", charset="UTF-8"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// escapePath escapes each element of a path for use in a link, keeping the slashes between them
+func escapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// browse lists the directories and files directly under a directory of the archive. Directories are not stored in
+// the archive, so they are worked out from the entry names
+func (a *archiveBrowser) browse(w http.ResponseWriter, r *http.Request) {
+	dir := strings.TrimPrefix(r.URL.Path, "/browse/")
+	if dir != "" && !strings.HasSuffix(dir, "/") {
+		http.Redirect(w, r, "/browse/"+escapePath(dir)+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	type dirTotal struct {
+		entries int
+		size    int64
+		modTime time.Time
+	}
+	dirs := map[string]*dirTotal{}
+	var items []browserItem
+	start := sort.Search(len(a.entries), func(i int) bool { return a.entries[i].Name >= dir })
+	for _, e := range a.entries[start:] {
+		if !strings.HasPrefix(e.Name, dir) {
+			break
+		}
+		rest := strings.TrimPrefix(e.Name, dir)
+		if sub, _, ok := strings.Cut(rest, "/"); ok {
+			t, ok := dirs[sub]
+			if !ok {
+				t = &dirTotal{}
+				dirs[sub] = t
+				items = append(items, browserItem{Name: sub + "/", Link: "/browse/" + escapePath(dir+sub) + "/", Dir: true})
+			}
+			t.entries++
+			t.size += e.Size
+			if e.ModTime.After(t.modTime) {
+				t.modTime = e.ModTime
+			}
+			continue
+		}
+		items = append(items, browserItem{
+			Name:    rest,
+			Link:    "/download/" + escapePath(e.Name),
+			Size:    ByteCountSI(e.Size),
+			ModTime: e.ModTime.Format("2006-01-02 15:04:05"),
+		})
+	}
+	if dir != "" && len(items) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	for i, item := range items {
+		if item.Dir {
+			t := dirs[strings.TrimSuffix(item.Name, "/")]
+			items[i].Size = fmt.Sprintf("%s in [%d] files", ByteCountSI(t.size), t.entries)
+			items[i].ModTime = t.modTime.Format("2006-01-02 15:04:05")
+		}
+	}
+	// directories first, then files, each by name
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Dir && !items[j].Dir })
+
+	crumbs := []browserItem{{Name: "root", Link: "/browse/"}}
+	parent := ""
+	for _, part := range strings.Split(strings.TrimSuffix(dir, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		parent += part + "/"
+		crumbs = append(crumbs, browserItem{Name: part, Link: "/browse/" + escapePath(parent)})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := browserTemplate.Execute(w, map[string]any{
+		"Archive": a.b.archiveName(),
+		"Dir":     dir,
+		"Crumbs":  crumbs,
+		"Items":   items,
+	})
+	if err != nil {
+		log.Printf("unable to write listing of [%s]: %v", dir, err)
+	}
+}
+
+// download sends a single entry of the archive as an attachment
+func (a *archiveBrowser) download(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/download/")
+	i := sort.Search(len(a.entries), func(i int) bool { return a.entries[i].Name >= name })
+	if i == len(a.entries) || a.entries[i].Name != name {
+		http.NotFound(w, r)
+		return
+	}
+
+	var written bool
+	err := a.b.readEntry(r.Context(), a.index, name, func(header *tar.Header, content io.Reader) error {
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(header.Size, 10))
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(name)}))
+		w.Header().Set("Last-Modified", header.ModTime.UTC().Format(http.TimeFormat))
+		written = true
+		if r.Method == http.MethodHead {
+			return nil
+		}
+		_, err := io.Copy(w, content)
+		return err
+	})
+	if err == nil {
+		return
+	}
+	log.Printf("unable to send [%s]: %v", name, err)
+	// once the content has started the status has been sent, so the response is just cut short
+	if written {
+		return
+	}
+	if errors.Is(err, errEntryNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	http.Error(w, "unable to read the entry from the archive", http.StatusBadGateway)
+}
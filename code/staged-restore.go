@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+	"github.com/schollz/progressbar/v3"
+)
+
+// blobs up to this size are promoted with a synchronous CopyFromURL, larger blobs use StartCopyFromURL
+const maxSyncCopySize = 256 * 1024 * 1024
+
+// stagedRestoreState records which phases of a staged restore have completed so a failed run can be resumed
+type stagedRestoreState struct {
+	TarFile          string `json:"tarFile"`
+	StagingContainer string `json:"stagingContainer"`
+	TargetContainer  string `json:"targetContainer"`
+	Restored         bool   `json:"restored"`
+	Verified         bool   `json:"verified"`
+	Promoted         bool   `json:"promoted"`
+}
+
+func (b *BlobArchiver) stagedStateFile() string {
+	return b.TarFile() + ".staged.json"
+}
+
+func (b *BlobArchiver) readStagedRestoreState(staging string) (*stagedRestoreState, error) {
+	state := &stagedRestoreState{
+		TarFile:          b.TarFile(),
+		StagingContainer: staging,
+		TargetContainer:  b.ContainerName,
+	}
+	f, err := os.ReadFile(b.stagedStateFile())
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open staged restore state : %w", err)
+	}
+	if err := json.Unmarshal(f, state); err != nil {
+		return nil, fmt.Errorf("unable to read staged restore state %s : %w", b.stagedStateFile(), err)
+	}
+	if state.StagingContainer != staging || state.TargetContainer != b.ContainerName {
+		return nil, fmt.Errorf("staged restore state %s is for staging container %s and target %s - remove it to start again",
+			b.stagedStateFile(), state.StagingContainer, state.TargetContainer)
+	}
+	log.Printf("resuming staged restore [restored: %v][verified: %v][promoted: %v]", state.Restored, state.Verified, state.Promoted)
+	return state, nil
+}
+
+func (b *BlobArchiver) writeStagedRestoreState(state *stagedRestoreState) error {
+	f, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(b.stagedStateFile(), f, 0600)
+}
+
+// StagedRestore restores the tar file into a staging container, verifies the staged blobs against the tar file and then
+// promotes them to the target container with server side copies. The completed phases are recorded next to the tar
+// file, so rerunning the same command resumes from the phase that failed
+func (b *BlobArchiver) StagedRestore() error {
+	ctx := context.Background()
+	target := b.ContainerName
+	staging := b.StagingContainerName
+	if staging == "" {
+		staging = target + "-staging"
+	}
+	if staging == target {
+		return fmt.Errorf("staging container must not be the target container %s", target)
+	}
+	// verification reads the whole tar file, which is only done locally
+	if b.RemoteTarFile {
+		return fmt.Errorf("a staged restore reads a local tar file - download the archive first or use --as-of")
+	}
+
+	state, err := b.readStagedRestoreState(staging)
+	if err != nil {
+		return err
+	}
+
+	if !state.Restored {
+		log.Printf("staged restore: restoring %s to staging container %s", b.TarFile(), staging)
+		// the staging container is always created, the user flags only decide whether the target is
+		// and the staging container holds nothing worth a safety backup
+		createTarget, skipSafetyBackup := b.CreateContainer, b.SkipSafetyBackup
+		b.ContainerName = staging
+		b.CreateContainer = true
+		b.SkipSafetyBackup = true
+		b.resumeRestore = true
+		err := b.RestoreFromTarFile()
+		b.ContainerName = target
+		b.CreateContainer = createTarget
+		b.SkipSafetyBackup = skipSafetyBackup
+		b.resumeRestore = false
+		if err != nil {
+			return fmt.Errorf("staged restore failed restoring to %s - rerun to resume: %w", staging, err)
+		}
+		state.Restored = true
+		if err := b.writeStagedRestoreState(state); err != nil {
+			return fmt.Errorf("unable to record staged restore state: %w", err)
+		}
+	}
+
+	if !state.Verified {
+		log.Printf("staged restore: verifying staging container %s against %s", staging, b.TarFile())
+		if err := b.verifyStagedRestore(ctx, staging); err != nil {
+			// the rerun restores again, uploading only the blobs whose size or content differs from the tar file
+			state.Restored = false
+			if err := b.writeStagedRestoreState(state); err != nil {
+				log.Printf("unable to record staged restore state: %v", err)
+			}
+			return fmt.Errorf("staged restore failed verification - nothing has been promoted to %s, rerun to restore the blobs that differ: %w", target, err)
+		}
+		state.Verified = true
+		if err := b.writeStagedRestoreState(state); err != nil {
+			return fmt.Errorf("unable to record staged restore state: %w", err)
+		}
+	}
+
+	if !state.Promoted {
+		log.Printf("staged restore: promoting staging container %s to %s", staging, target)
+		if b.CreateContainer {
+			var props *containerProperties
+			if b.ApplyContainerProperties {
+				manifest, err := readManifest(manifestFile(b.TarFile()))
+				if err != nil {
+					return fmt.Errorf("container properties recorded at backup time are not available: %w", err)
+				}
+				props = &manifest.Container
+			}
+			if err := b.createContainerIfMissing(ctx, props); err != nil {
+				return err
+			}
+		}
+		if err := b.promoteStagedRestore(ctx, staging); err != nil {
+			return fmt.Errorf("staged restore failed promoting to %s - rerun to resume: %w", target, err)
+		}
+		state.Promoted = true
+		if err := b.writeStagedRestoreState(state); err != nil {
+			return fmt.Errorf("unable to record staged restore state: %w", err)
+		}
+	}
+
+	// the state only describes this run, so a later restore of the same tar file starts from the beginning
+	if err := os.Remove(b.stagedStateFile()); err != nil {
+		log.Printf("unable to remove staged restore state %s: %v", b.stagedStateFile(), err)
+	}
+	log.Printf("staged restore complete - staging container %s can be deleted once the restore has been checked", staging)
+	return nil
+}
+
+// verifyStagedRestore checks every entry in the tar file has been restored to the staging container with the same size
+// and content. The Content-MD5 set on each staged blob as it was uploaded is compared with the MD5 recorded in the
+// manifest, or with the MD5 of the entry when the manifest does not record one
+func (b *BlobArchiver) verifyStagedRestore(ctx context.Context, staging string) error {
+	containerClient, err := b.createContainerClient(b.ConnectionString, staging)
+	if err != nil {
+		return fmt.Errorf("failed to create container client: %w", err)
+	}
+	staged, err := listBlobs(ctx, containerClient, b.prefix)
+	if err != nil {
+		return err
+	}
+
+	filter, err := b.entryFilter()
+	if err != nil {
+		return err
+	}
+	recorded := map[string]string{}
+	if manifest, err := readManifest(manifestFile(b.TarFile())); err == nil {
+		for _, e := range manifest.Entries {
+			recorded[e.Name] = e.MD5
+		}
+	}
+	tarReader, closeTarFile, err := openTarFile(b.TarFile(), b.Compression)
+	if err != nil {
+		return err
+	}
+	defer closeTarFile()
+
+	bar := progressbar.Default(int64(len(staged)), "verifying staged blobs")
+	var entries, missing, mismatched, corrupt int
+	verified := map[string]bool{}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar file: %w", err)
+		}
+		if !filter.Match(header.Name) {
+			continue
+		}
+		entries++
+		blobName := b.restoredBlobName(header.Name)
+		item, ok := staged[blobName]
+		switch {
+		case !ok:
+			missing++
+			log.Printf("blob %s is missing from staging container %s", blobName, staging)
+		case *item.Properties.ContentLength != header.Size:
+			mismatched++
+			log.Printf("blob %s is [%d] bytes in staging container %s, expected [%d]", blobName, *item.Properties.ContentLength, staging, header.Size)
+		default:
+			want := recorded[header.Name]
+			if want == "" {
+				h := md5.New()
+				if _, err := io.Copy(h, tarReader); err != nil {
+					return fmt.Errorf("failed to read tar file: %w", err)
+				}
+				want = base64.StdEncoding.EncodeToString(h.Sum(nil))
+			}
+			if got := base64.StdEncoding.EncodeToString(item.Properties.ContentMD5); got != want {
+				corrupt++
+				log.Printf("blob %s in staging container %s has Content-MD5 [%s], expected [%s]", blobName, staging, got, want)
+				break
+			}
+			verified[blobName] = true
+		}
+		bar.Add(1)
+	}
+	if missing > 0 || mismatched > 0 || corrupt > 0 {
+		return fmt.Errorf("[%d] of [%d] entries missing, [%d] with the wrong size and [%d] with the wrong content in staging container %s",
+			missing, entries, mismatched, corrupt, staging)
+	}
+	// every staged blob is promoted, so a blob that is not in the tar file would reach the target unverified
+	if extra := len(staged) - len(verified); extra > 0 {
+		return fmt.Errorf("staging container %s holds [%d] blobs that are not in the tar file - empty it and rerun", staging, extra)
+	}
+	log.Printf("[%d] staged blobs verified", entries)
+	return nil
+}
+
+// promoteStagedRestore copies every blob in the staging container to the target container server side. Blobs that an
+// earlier run has already copied from the staging container are skipped
+func (b *BlobArchiver) promoteStagedRestore(ctx context.Context, staging string) error {
+	stagingClient, err := b.createContainerClient(b.ConnectionString, staging)
+	if err != nil {
+		return fmt.Errorf("failed to create container client: %w", err)
+	}
+	targetClient, err := b.createContainerClient(b.ConnectionString, b.ContainerName)
+	if err != nil {
+		return fmt.Errorf("failed to create container client: %w", err)
+	}
+	staged, err := listBlobs(ctx, stagingClient, b.prefix)
+	if err != nil {
+		return err
+	}
+	existing, err := listBlobs(ctx, targetClient, b.prefix)
+	if err != nil {
+		return err
+	}
+
+	// the copy source is read with a short lived SAS so the copy works whatever credential the target uses
+	sasURL, err := stagingClient.GetSASURL(sas.ContainerPermissions{Read: true}, time.Now().Add(24*time.Hour), nil)
+	if err != nil {
+		return fmt.Errorf("unable to create SAS for staging container %s: %w", staging, err)
+	}
+	sourceClient, err := container.NewClientWithNoCredential(sasURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create staging container client: %w", err)
+	}
+
+	if !b.SkipSafetyBackup {
+		var overwritten []*container.BlobItem
+		for name, item := range staged {
+			if t, ok := existing[name]; ok && !alreadyPromoted(t, item, sourceClient.NewBlobClient(name).URL()) {
+				overwritten = append(overwritten, t)
+			}
+		}
+		if _, err := b.safetyBackup(overwritten, "restore"); err != nil {
+			return fmt.Errorf("nothing has been promoted: %w", err)
+		}
+	}
+
+	bar := progressbar.Default(int64(len(staged)), "promoting staged blobs")
+	blobChan := make(chan *container.BlobItem, b.Workers)
+	var wg sync.WaitGroup
+	var countMutex sync.Mutex
+	var copied, skipped, failed int
+
+	for i := 0; i < b.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range blobChan {
+				source := sourceClient.NewBlobClient(*item.Name).URL()
+				err := copyBlobFromURL(ctx, source, targetClient.NewBlobClient(*item.Name), *item.Properties.ContentLength)
+				countMutex.Lock()
+				if err != nil {
+					log.Printf("failed to promote %s: %v", *item.Name, err)
+					failed++
+				} else {
+					copied++
+				}
+				countMutex.Unlock()
+				bar.Add(1)
+			}
+		}()
+	}
+
+	for name, item := range staged {
+		if t, ok := existing[name]; ok && alreadyPromoted(t, item, sourceClient.NewBlobClient(name).URL()) {
+			skipped++
+			bar.Add(1)
+			continue
+		}
+		blobChan <- item
+	}
+	close(blobChan)
+	wg.Wait()
+
+	log.Printf("[%d] blobs promoted, [%d] already promoted, [%d] failed", copied, skipped, failed)
+	if failed > 0 {
+		return fmt.Errorf("[%d] blobs failed to promote to container %s", failed, b.ContainerName)
+	}
+	return nil
+}
+
+// alreadyPromoted reports whether target was successfully copied from the staged blob after it was last written
+func alreadyPromoted(target, staged *container.BlobItem, source string) bool {
+	p := target.Properties
+	if p.CopyStatus == nil || *p.CopyStatus != blob.CopyStatusTypeSuccess || p.CopySource == nil || p.CopyCompletionTime == nil {
+		return false
+	}
+	if strings.SplitN(*p.CopySource, "?", 2)[0] != strings.SplitN(source, "?", 2)[0] {
+		return false
+	}
+	return !p.CopyCompletionTime.Before(*staged.Properties.LastModified)
+}
+
+// copyBlobFromURL copies a blob server side. Small blobs are copied synchronously, larger blobs are copied
+// asynchronously and polled until the copy completes
+func copyBlobFromURL(ctx context.Context, source string, destination *blob.Client, size int64) error {
+	if size <= maxSyncCopySize {
+		_, err := destination.CopyFromURL(ctx, source, nil)
+		return err
+	}
+	resp, err := destination.StartCopyFromURL(ctx, source, nil)
+	if err != nil {
+		return err
+	}
+	status := resp.CopyStatus
+	for status != nil && *status == blob.CopyStatusTypePending {
+		time.Sleep(2 * time.Second)
+		props, err := destination.GetProperties(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("unable to check copy status: %w", err)
+		}
+		status = props.CopyStatus
+	}
+	if status != nil && *status != blob.CopyStatusTypeSuccess {
+		return fmt.Errorf("copy finished with status %s", *status)
+	}
+	return nil
+}
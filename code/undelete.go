@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/schollz/progressbar/v3"
+)
+
+// UndeleteBlobs restores soft deleted blobs under the prefix, optionally only those deleted within a time window.
+// Soft delete must be enabled on the storage account and the blobs still within its retention period
+func (b *BlobArchiver) UndeleteBlobs() error {
+	ctx := context.Background()
+
+	var deletedAfter, deletedBefore time.Time
+	var err error
+	if b.DeletedAfter != "" {
+		if deletedAfter, err = parseArchiveDate(b.DeletedAfter); err != nil {
+			return err
+		}
+	}
+	if b.DeletedBefore != "" {
+		if deletedBefore, err = parseArchiveDate(b.DeletedBefore); err != nil {
+			return err
+		}
+	}
+	filter, err := b.entryFilter()
+	if err != nil {
+		return err
+	}
+
+	containerClient, err := b.createContainerClient(b.ConnectionString, b.ContainerName)
+	if err != nil {
+		return fmt.Errorf("failed to create container client: %w", err)
+	}
+
+	bar := progressbar.Default(-1, "blobs undeleted")
+	nameChan := make(chan string, b.BatchSize)
+	var wg sync.WaitGroup
+	var recovered, failed atomic.Int64
+
+	for i := 0; i < b.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range nameChan {
+				if _, err := containerClient.NewBlobClient(name).Undelete(ctx, nil); err != nil {
+					log.Printf("failed to undelete %s: %v", name, err)
+					failed.Add(1)
+					continue
+				}
+				recovered.Add(1)
+				bar.Add(1)
+			}
+		}()
+	}
+
+	var matched int64
+	pager := containerClient.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+		Prefix:  &b.prefix,
+		Include: container.ListBlobsInclude{Deleted: true},
+	})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			close(nameChan)
+			wg.Wait()
+			return fmt.Errorf("failed to list blobs: %w", err)
+		}
+		for _, blobItem := range page.Segment.BlobItems {
+			if blobItem.Deleted == nil || !*blobItem.Deleted || !filter.Match(*blobItem.Name) {
+				continue
+			}
+			deletedTime := blobItem.Properties.DeletedTime
+			if !deletedAfter.IsZero() && (deletedTime == nil || deletedTime.Before(deletedAfter)) {
+				continue
+			}
+			if !deletedBefore.IsZero() && (deletedTime == nil || !deletedTime.Before(deletedBefore)) {
+				continue
+			}
+			matched++
+			if b.DryRun {
+				fmt.Println(*blobItem.Name)
+				continue
+			}
+			nameChan <- *blobItem.Name
+		}
+	}
+	close(nameChan)
+	wg.Wait()
+
+	if b.DryRun {
+		log.Printf("dry run: [%d] soft deleted blobs would be undeleted in container %s", matched, b.ContainerName)
+		return nil
+	}
+	log.Printf("[%d] soft deleted blobs found, [%d] recovered, [%d] failed in container %s", matched, recovered.Load(), failed.Load(), b.ContainerName)
+	if failed.Load() > 0 {
+		return fmt.Errorf("[%d] blobs could not be undeleted", failed.Load())
+	}
+	return nil
+}
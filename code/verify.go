@@ -0,0 +1,168 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// countingReader counts the bytes read through it so a failure can be reported with its offset
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// openRawArchive opens the bytes of the tar file, or with RemoteTarFile the archive blob in the destination container,
+// without decompressing them. It also returns the size of the archive
+func (b *BlobArchiver) openRawArchive(ctx context.Context) (io.ReadCloser, int64, error) {
+	if !b.RemoteTarFile {
+		f, err := os.Open(b.TarFile())
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to open tar file: %w", err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, fmt.Errorf("failed to open tar file: %w", err)
+		}
+		return f, info.Size(), nil
+	}
+	containerClient, err := b.createContainerClient(b.DestinationConnectionString, b.DestinationContainerName)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create container client: %w", err)
+	}
+	resp, err := containerClient.NewBlobClient(b.TarFileName).DownloadStream(ctx, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to download archive %s: %w", b.TarFileName, err)
+	}
+	var size int64
+	if resp.ContentLength != nil {
+		size = *resp.ContentLength
+	}
+	return resp.Body, size, nil
+}
+
+// VerifyArchive reads the whole of a local tar file, or an archive in the destination container, checking the gzip
+// framing and checksum of a compressed archive and parsing every tar header. When the archive has a manifest listing
+// its blobs, every entry is checked against the recorded size and MD5 and every recorded blob must be present. Any
+// problem is returned as an error, with the offset it was found at for truncation or corruption
+func (b *BlobArchiver) VerifyArchive() error {
+	ctx := context.Background()
+	compressed := strings.HasSuffix(b.archiveName(), ".tgz") || (!b.RemoteTarFile && b.Compression)
+
+	manifest, err := b.archiveManifestIfAny(ctx)
+	if err != nil {
+		return err
+	}
+	expected := map[string]manifestEntry{}
+	if manifest != nil {
+		for _, e := range manifest.Entries {
+			expected[e.Name] = e
+		}
+	}
+	if len(expected) == 0 {
+		log.Printf("%s has no manifest listing its blobs - only the archive structure is verified", b.archiveName())
+	}
+
+	raw, size, err := b.openRawArchive(ctx)
+	if err != nil {
+		return err
+	}
+	defer raw.Close()
+
+	bar := progressbar.DefaultBytes(size, "verifying archive")
+	rawCounter := &countingReader{r: io.TeeReader(raw, bar)}
+	var stream io.Reader = rawCounter
+	var gzipReader *gzip.Reader
+	if compressed {
+		if gzipReader, err = gzip.NewReader(rawCounter); err != nil {
+			return fmt.Errorf("%s is not a valid gzip stream: %w", b.archiveName(), err)
+		}
+		defer gzipReader.Close()
+		stream = gzipReader
+	}
+	tarCounter := &countingReader{r: stream}
+	tarReader := tar.NewReader(tarCounter)
+
+	// corrupt describes where a read failed. The compressed offset is only meaningful for a compressed archive
+	corrupt := func(what string, err error) error {
+		if compressed {
+			return fmt.Errorf("%s corrupt or truncated %s at tar offset %d (compressed offset %d): %w", b.archiveName(), what, tarCounter.n, rawCounter.n, err)
+		}
+		return fmt.Errorf("%s corrupt or truncated %s at offset %d: %w", b.archiveName(), what, tarCounter.n, err)
+	}
+
+	var entries, problems int
+	seen := map[string]bool{}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return corrupt("reading a tar header", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		entries++
+		hash := md5.New()
+		n, err := io.Copy(hash, tarReader)
+		if err != nil {
+			return corrupt(fmt.Sprintf("reading entry [%s]", header.Name), err)
+		}
+		if n != header.Size {
+			return corrupt(fmt.Sprintf("reading entry [%s] - [%d] of [%d] bytes", header.Name, n, header.Size), io.ErrUnexpectedEOF)
+		}
+		if len(expected) == 0 {
+			continue
+		}
+		seen[header.Name] = true
+		e, ok := expected[header.Name]
+		switch {
+		case !ok:
+			log.Printf("entry [%s] is not in the manifest", header.Name)
+			problems++
+		case e.Size != header.Size:
+			log.Printf("entry [%s] is [%d] bytes, the manifest records [%d]", header.Name, header.Size, e.Size)
+			problems++
+		case e.MD5 != "" && e.MD5 != base64.StdEncoding.EncodeToString(hash.Sum(nil)):
+			log.Printf("entry [%s] does not match the MD5 recorded in the manifest", header.Name)
+			problems++
+		}
+	}
+
+	// the tar reader stops at the end of archive marker, so the rest of the gzip stream is read to check its trailer
+	if gzipReader != nil {
+		if _, err := io.Copy(io.Discard, gzipReader); err != nil {
+			return corrupt("reading the gzip trailer", err)
+		}
+	}
+
+	for name := range expected {
+		if !seen[name] {
+			log.Printf("entry [%s] is in the manifest but not the archive", name)
+			problems++
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("%s failed verification - [%d] entries missing or not matching the manifest, [%d] entries read", b.archiveName(), problems, entries)
+	}
+	log.Printf("%s verified - [%d] entries, %s", b.archiveName(), entries, ByteCountSI(tarCounter.n))
+	return nil
+}